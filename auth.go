@@ -0,0 +1,55 @@
+// +build !js,!wasm
+
+package wasmws
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+//Authenticator is called by a WebSockListener with each HTTP request before it
+// is upgraded to a websocket. Returning an error rejects the request before any
+// websocket traffic occurs, an *AuthError may be returned to control the HTTP
+// status code, otherwise 401 (Unauthorized) is used. If the request is accepted,
+// the returned identity (which may be nil) is attached to the connection; See:
+// WebSockConn.Identity
+type Authenticator func(req *http.Request) (identity interface{}, err error)
+
+//AuthError is an error an Authenticator may return to reject an upgrade request
+// with a specific HTTP status code, typically 401 (Unauthorized) or 403 (Forbidden)
+type AuthError struct {
+	StatusCode int
+	Reason     string //Reason is sent to the client in the response body
+}
+
+//NewAuthError returns an AuthError with the provided status code and reason
+func NewAuthError(statusCode int, reason string) *AuthError {
+	return &AuthError{StatusCode: statusCode, Reason: reason}
+}
+
+func (err *AuthError) Error() string {
+	return fmt.Sprintf("WebSockListener: Authentication failed with status %d; Details: %s", err.StatusCode, err.Reason)
+}
+
+//authenticate runs the provided Authenticator (if any) and writes a rejection
+// to the response if it fails
+func authenticate(auth Authenticator, wtr http.ResponseWriter, req *http.Request) (identity interface{}, err error) {
+	if auth == nil {
+		return nil, nil
+	}
+	if identity, err = auth(req); err == nil {
+		return identity, nil
+	}
+
+	statusCode, reason := http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized)
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		statusCode = authErr.StatusCode
+		if reason = authErr.Reason; reason == "" {
+			reason = http.StatusText(statusCode)
+		}
+	}
+	http.Error(wtr, fmt.Sprintf("%d: %s", statusCode, reason), statusCode)
+	return nil, err
+}
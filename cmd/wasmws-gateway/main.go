@@ -0,0 +1,188 @@
+//Command wasmws-gateway exposes TCP services to WASM (or native) wasmws clients:
+// It accepts websockets on the configured paths and proxies each of them to the
+// TCP backend of its path. For example, to expose Postgres and Redis:
+//	wasmws-gateway -listen :8080 -route /postgres=db:5432 -route /redis=cache:6379
+// Clients then dial "ws://gateway:8080/postgres" using wasmws.DialContext.
+//
+// A tunnel path may also be served, where clients choose the TCP address to
+// connect to by speaking SOCKS5 or sending an HTTP CONNECT request over the
+// websocket. Only addresses matching an -allow entry may be connected to:
+//	wasmws-gateway -tunnel /tunnel -allow '*.internal:*' -allow 10.0.0.0/8:443
+// Clients then use wasmws.DialTunnel(ctx, "ws://gateway:8080/tunnel", "db.internal:5432").
+//
+// Only same origin browser clients are accepted unless -origin patterns are
+// provided, ex. when the WASM application is served from a CDN:
+//	wasmws-gateway -route /postgres=db:5432 -origin app.example.com -tls-cert cert.pem -tls-key key.pem
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tarndt/wasmws"
+)
+
+//routeFlags are the values of the repeatable -route flag in the form path=host:port
+type routeFlags map[string]string
+
+func (routes routeFlags) String() string {
+	pairs := make([]string, 0, len(routes))
+	for path, backend := range routes {
+		pairs = append(pairs, path+"="+backend)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (routes routeFlags) Set(value string) error {
+	sep := strings.IndexByte(value, '=')
+	if sep < 1 {
+		return fmt.Errorf("Route %q is not in the form path=host:port", value)
+	}
+	path, backend := value[:sep], value[sep+1:]
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("Route %q has a path that does not start with '/'", value)
+	}
+	if _, _, err := net.SplitHostPort(backend); err != nil {
+		return fmt.Errorf("Route %q has an invalid backend address; Details: %s", value, err)
+	}
+	if _, found := routes[path]; found {
+		return fmt.Errorf("Route path %q was provided more than once", path)
+	}
+	routes[path] = backend
+	return nil
+}
+
+//originFlags are the values of the repeatable -origin flag, host patterns of
+// authorized cross origin clients
+type originFlags []string
+
+func (origins originFlags) String() string {
+	return strings.Join(origins, ",")
+}
+
+func (origins *originFlags) Set(value string) error {
+	if _, err := filepath.Match(value, ""); err != nil {
+		return fmt.Errorf("Origin %q is not a valid pattern; Details: %s", value, err)
+	}
+	*origins = append(*origins, value)
+	return nil
+}
+
+func main() {
+	routes := make(routeFlags)
+	flag.Var(routes, "route", "Proxy websockets accepted on a path to a TCP backend, in the form path=host:port (repeatable)")
+	tunnelPath := flag.String("tunnel", "", "Path to accept websockets on that request their TCP target using SOCKS5 or HTTP CONNECT")
+	var allow allowlist
+	flag.Var(&allow, "allow", "Target permitted for tunnels in the form host:port; host may be a name, *.domain, an IP, a CIDR block or *, and port may be * (repeatable)")
+	var origins originFlags
+	flag.Var(&origins, "origin", "Host pattern (see: path/filepath.Match) of cross origin clients to accept, ex. *.example.com; Same origin clients are always accepted (repeatable)")
+	maxConns := flag.Int("max-conns", 0, "Maximum open websockets per path, further requests are refused; zero is unlimited")
+	listenAddr := flag.String("listen", ":8080", "Address to serve HTTP on")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file to serve HTTPS with, requires -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file to serve HTTPS with, requires -tls-cert")
+	connectTimeout := flag.Duration("connect-timeout", time.Second*10, "Maximum time to connect to a backend")
+	halfCloseTimeout := flag.Duration("half-close-timeout", time.Second*30, "Time a backend may keep sending after its client closed the websocket")
+	pingInterval := flag.Duration("ping-interval", time.Second*30, "How often websockets are pinged to keep them alive, zero disables pings")
+	shutdownTimeout := flag.Duration("shutdown-timeout", time.Second*10, "Time proxied connections have to finish when shutting down")
+	flag.Parse()
+	switch {
+	case len(routes) < 1 && *tunnelPath == "":
+		fmt.Fprintln(os.Stderr, "At least one -route or a -tunnel must be provided")
+		flag.Usage()
+		os.Exit(2)
+	case *tunnelPath != "" && len(allow) < 1:
+		fmt.Fprintln(os.Stderr, "A -tunnel requires at least one -allow entry")
+		flag.Usage()
+		os.Exit(2)
+	case *tunnelPath != "" && routes[*tunnelPath] != "":
+		fmt.Fprintf(os.Stderr, "The -tunnel path %q is also a -route path\n", *tunnelPath)
+		os.Exit(2)
+	case (*tlsCert == "") != (*tlsKey == ""):
+		fmt.Fprintln(os.Stderr, "The -tls-cert and -tls-key flags must be provided together")
+		flag.Usage()
+		os.Exit(2)
+	case *maxConns < 0:
+		fmt.Fprintln(os.Stderr, "The -max-conns flag may not be negative")
+		os.Exit(2)
+	}
+
+	//App context setup
+	appCtx, appCancel := context.WithCancel(context.Background())
+	defer appCancel()
+
+	//Setup a websocket listener and proxy per route
+	listenerOpts := wasmws.ListenerOptions{
+		OriginPatterns: origins,
+		MaxConnections: *maxConns,
+		PingInterval:   *pingInterval,
+	}
+	router := http.NewServeMux()
+	var listeners []*wasmws.WebSockListener
+	for path, backend := range routes {
+		wsl := wasmws.NewWebSocketListenerWithOptions(appCtx, listenerOpts)
+		router.Handle(path, wsl)
+		listeners = append(listeners, wsl)
+
+		proxy := &tcpProxy{backend: backend, connectTimeout: *connectTimeout, halfCloseTimeout: *halfCloseTimeout}
+		go func(path string) {
+			defer appCancel()
+			if err := proxy.serve(wsl); err != nil {
+				log.Printf("ERROR: Failed to accept websockets on %q; Details: %s", path, err)
+			}
+		}(path)
+		log.Printf("INFO: Proxying websockets on %q to %s", path, backend)
+	}
+	if *tunnelPath != "" {
+		wsl := wasmws.NewWebSocketListenerWithOptions(appCtx, listenerOpts)
+		router.Handle(*tunnelPath, wsl)
+		listeners = append(listeners, wsl)
+
+		proxy := &tunnelProxy{allow: allow, connectTimeout: *connectTimeout, halfCloseTimeout: *halfCloseTimeout}
+		go func() {
+			defer appCancel()
+			if err := proxy.serve(wsl); err != nil {
+				log.Printf("ERROR: Failed to accept websockets on %q; Details: %s", *tunnelPath, err)
+			}
+		}()
+		log.Printf("INFO: Tunneling websockets on %q to %s", *tunnelPath, allow.String())
+	}
+
+	//Run HTTP server
+	httpServer := &http.Server{Addr: *listenAddr, Handler: router}
+	go func() {
+		defer appCancel()
+		if *tlsCert != "" {
+			log.Printf("ERROR: HTTPS Listen and Server failed; Details: %s", httpServer.ListenAndServeTLS(*tlsCert, *tlsKey))
+			return
+		}
+		log.Printf("ERROR: HTTP Listen and Server failed; Details: %s", httpServer.ListenAndServe())
+	}()
+
+	//Handle signals
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		log.Printf("INFO: Received shutdown signal: %s", <-sigs)
+		appCancel()
+	}()
+
+	//Shutdown
+	<-appCtx.Done()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer shutdownCancel()
+
+	httpServer.Shutdown(shutdownCtx)
+	for _, wsl := range listeners {
+		wsl.Shutdown(shutdownCtx)
+	}
+}
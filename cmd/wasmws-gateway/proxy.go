@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+//tcpProxy proxies accepted connections to a TCP backend
+type tcpProxy struct {
+	backend          string
+	connectTimeout   time.Duration
+	halfCloseTimeout time.Duration
+}
+
+//serve proxies the connections accepted by the listener until it is closed
+func (proxy *tcpProxy) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go proxy.proxy(conn)
+	}
+}
+
+//proxy connects to the backend and proxies the connection to it until either
+// side is done
+func (proxy *tcpProxy) proxy(conn net.Conn) {
+	defer conn.Close()
+
+	backend, err := net.DialTimeout("tcp", proxy.backend, proxy.connectTimeout)
+	if err != nil {
+		log.Printf("ERROR: Could not connect %s to backend %s; Details: %s", conn.RemoteAddr(), proxy.backend, err)
+		return
+	}
+	defer backend.Close()
+
+	sent, received := pipe(conn, backend, proxy.halfCloseTimeout)
+	log.Printf("INFO: Closed connection of %s to backend %s (sent: %d bytes, received: %d bytes)", conn.RemoteAddr(), proxy.backend, sent, received)
+}
+
+//pipe copies data between a websocket and a TCP connection in both directions
+// until both are done, it returns the number of bytes sent to and received from
+// the TCP connection. Websockets cannot be half-closed, so:
+//  - Once the TCP connection has nothing more to send, the websocket is closed
+//    after everything received was sent on it.
+//  - Once the websocket is closed, the TCP connection is half-closed so it can
+//    finish gracefully, it is closed if it does not within halfCloseTimeout.
+func pipe(ws net.Conn, tcp net.Conn, halfCloseTimeout time.Duration) (sent, received int64) {
+	sentCh := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(tcp, ws)
+		if tcpConn, ok := tcp.(interface{ CloseWrite() error }); ok {
+			tcpConn.CloseWrite()
+		}
+		tcp.SetReadDeadline(time.Now().Add(halfCloseTimeout))
+		sentCh <- n
+	}()
+
+	received, _ = io.Copy(ws, tcp)
+	ws.Close() //Unblocks the copy to tcp if it is still running
+	return <-sentCh, received
+}
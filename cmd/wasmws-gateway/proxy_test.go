@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tarndt/wasmws"
+)
+
+//newTestGateway returns the websocket URL of a gateway proxying to the provided
+// backend address
+func newTestGateway(t *testing.T, backend string) string {
+	proxy := &tcpProxy{backend: backend, connectTimeout: time.Second, halfCloseTimeout: time.Second}
+	return newTestListener(t, proxy.serve)
+}
+
+//newTestListener returns the websocket URL of a test server whose accepted
+// connections are served by the provided function
+func newTestListener(t *testing.T, serve func(net.Listener) error) string {
+	wsl := wasmws.NewWebSocketListener(context.Background())
+	server := httptest.NewServer(wsl)
+	t.Cleanup(func() {
+		wsl.Close()
+		server.Close()
+	})
+
+	go serve(wsl)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+//newTestBackend returns the address of a TCP server handling each connection
+// with the provided function
+func newTestBackend(t *testing.T, handle func(net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen for test backend; Details: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestProxyEcho(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	backendDone := make(chan error, 1)
+	wsURL := newTestGateway(t, newTestBackend(t, func(conn net.Conn) {
+		_, err := io.Copy(conn, conn)
+		backendDone <- err
+	}))
+
+	conn, err := wasmws.DialContext(testCtx, "websocket", wsURL)
+	if err != nil {
+		t.Fatalf("Could not dial gateway at %q; Details: %s", wsURL, err)
+	}
+	msg := []byte("Hello backend")
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatalf("Could not write to gateway; Details: %s", err)
+	}
+	reply := make([]byte, len(msg))
+	if _, err = io.ReadFull(conn, reply); err != nil || string(reply) != string(msg) {
+		t.Fatalf("Gateway echoed %q rather than %q; Details: %v", reply, msg, err)
+	}
+
+	//Closing the websocket half-closes the backend connection
+	conn.Close()
+	select {
+	case err = <-backendDone:
+		if err != nil {
+			t.Fatalf("Backend should have read EOF once the websocket was closed, not: %s", err)
+		}
+	case <-testCtx.Done():
+		t.Fatalf("Backend did not observe the websocket close")
+	}
+}
+
+func TestProxyBackendClose(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	//Everything the backend sent is received before the websocket is closed
+	msg := strings.Repeat("Goodbye ", 64*1024)
+	wsURL := newTestGateway(t, newTestBackend(t, func(conn net.Conn) {
+		io.WriteString(conn, msg)
+	}))
+
+	conn, err := wasmws.DialContext(testCtx, "websocket", wsURL)
+	if err != nil {
+		t.Fatalf("Could not dial gateway at %q; Details: %s", wsURL, err)
+	}
+	defer conn.Close()
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil || string(reply) != msg {
+		t.Fatalf("Gateway returned %d bytes rather than %d; Details: %v", len(reply), len(msg), err)
+	}
+}
+
+func TestProxyUnreachable(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	//Find an address nothing is listening on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen; Details: %s", err)
+	}
+	backend := ln.Addr().String()
+	ln.Close()
+
+	wsURL := newTestGateway(t, backend)
+	conn, err := wasmws.DialContext(testCtx, "websocket", wsURL)
+	if err != nil {
+		t.Fatalf("Could not dial gateway at %q; Details: %s", wsURL, err)
+	}
+	defer conn.Close()
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Read of a websocket with an unreachable backend returned %d bytes rather than failing", n)
+	}
+}
+
+func TestRouteFlags(t *testing.T) {
+	routes := make(routeFlags)
+	for _, value := range []string{"/postgres=db:5432", "/redis=[::1]:6379"} {
+		if err := routes.Set(value); err != nil {
+			t.Fatalf("Valid route %q was rejected; Details: %s", value, err)
+		}
+	}
+	for _, value := range []string{"/postgres=db:5433", "noslash=db:5432", "/path=db", "/path"} {
+		if err := routes.Set(value); err == nil {
+			t.Fatalf("Invalid route %q was accepted", value)
+		}
+	}
+	if routes["/postgres"] != "db:5432" || routes["/redis"] != "[::1]:6379" {
+		t.Fatalf("Routes were parsed as %v", routes)
+	}
+}
+
+func TestOriginFlags(t *testing.T) {
+	var origins originFlags
+	for _, value := range []string{"app.example.com", "*.example.com"} {
+		if err := origins.Set(value); err != nil {
+			t.Fatalf("Valid origin %q was rejected; Details: %s", value, err)
+		}
+	}
+	if err := origins.Set("[example.com"); err == nil {
+		t.Fatalf("Invalid origin pattern was accepted")
+	}
+	if origins.String() != "app.example.com,*.example.com" {
+		t.Fatalf("Origins were parsed as %v", origins)
+	}
+}
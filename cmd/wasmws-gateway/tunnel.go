@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//tunnelProxy proxies accepted connections to the TCP address each requests using
+// SOCKS5 (RFC 1928, CONNECT without authentication) or an HTTP CONNECT request,
+// as permitted by its allowlist; Clients use wasmws.DialTunnel.
+type tunnelProxy struct {
+	allow            allowlist
+	connectTimeout   time.Duration
+	halfCloseTimeout time.Duration
+}
+
+//tunnelRequestTimeout is the time clients have to request a target
+const tunnelRequestTimeout = time.Second * 30
+
+//SOCKS5 protocol values
+const (
+	socks5Version     = 5
+	socks5NoAuth      = 0
+	socks5NoMethods   = 0xFF
+	socks5Connect     = 1
+	socks5AddrIPv4    = 1
+	socks5AddrDomain  = 3
+	socks5AddrIPv6    = 4
+	socks5Succeeded   = 0
+	socks5Failure     = 1
+	socks5NotAllowed  = 2
+	socks5Unreachable = 4
+	socks5Refused     = 5
+	socks5TimedOut    = 6
+	socks5BadCommand  = 7
+	socks5BadAddrType = 8
+)
+
+//serve proxies the connections accepted by the listener until it is closed
+func (proxy *tunnelProxy) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go proxy.proxy(conn)
+	}
+}
+
+//proxy reads the target requested by the client, connects to it and proxies the
+// connection to it until either side is done
+func (proxy *tunnelProxy) proxy(conn net.Conn) {
+	defer conn.Close()
+
+	rdr := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(tunnelRequestTimeout))
+	first, err := rdr.Peek(1)
+	if err != nil {
+		log.Printf("ERROR: Could not read tunnel request of %s; Details: %s", conn.RemoteAddr(), err)
+		return
+	}
+	var target net.Conn
+	if first[0] == socks5Version {
+		target, err = proxy.socks5(conn, rdr)
+	} else {
+		target, err = proxy.httpConnect(conn, rdr)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Printf("ERROR: Could not tunnel %s; Details: %s", conn.RemoteAddr(), err)
+		return
+	}
+	defer target.Close()
+
+	//Data the client sent after its request may already be buffered
+	sent, received := pipe(bufferedConn{Conn: conn, rdr: rdr}, target, proxy.halfCloseTimeout)
+	log.Printf("INFO: Closed tunnel of %s to %s (sent: %d bytes, received: %d bytes)", conn.RemoteAddr(), target.RemoteAddr(), sent, received)
+}
+
+//connect connects to the target address if the allowlist permits it and the IP
+// it resolves to
+func (proxy *tunnelProxy) connect(address string) (net.Conn, error) {
+	_, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errNotAllowed
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, errNotAllowed
+	}
+	named := proxy.allow.permits(address)
+	if !named && !proxy.allow.hasIPEntry(port) { //Don't resolve names that can't be permitted
+		return nil, errNotAllowed
+	}
+
+	dialer := net.Dialer{
+		Timeout: proxy.connectTimeout,
+		Control: func(network, resolved string, _ syscall.RawConn) error { //Check the IP actually connected to
+			host, _, err := net.SplitHostPort(resolved)
+			if err != nil {
+				return err
+			}
+			if !proxy.allow.permitsIP(net.ParseIP(host), port, named) {
+				return errNotAllowed
+			}
+			return nil
+		},
+	}
+	return dialer.Dial("tcp", address)
+}
+
+var errNotAllowed = errors.New("Target is not permitted by the allowlist")
+
+//socks5 handles a SOCKS5 request, returning the connection to the target
+func (proxy *tunnelProxy) socks5(conn net.Conn, rdr *bufio.Reader) (net.Conn, error) {
+	//Greeting: version | method count | methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(rdr, header); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(rdr, methods); err != nil {
+		return nil, err
+	}
+	if bytes.IndexByte(methods, socks5NoAuth) < 0 {
+		conn.Write([]byte{socks5Version, socks5NoMethods})
+		return nil, errors.New("SOCKS5 client does not support connecting without authentication")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5NoAuth}); err != nil {
+		return nil, err
+	}
+
+	//Request: version | command | reserved | address type | address | port
+	header = make([]byte, 4)
+	if _, err := io.ReadFull(rdr, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version || header[2] != 0 {
+		socks5Reply(conn, socks5Failure, nil)
+		return nil, fmt.Errorf("SOCKS5 request is malformed (version: %d, reserved: %d)", header[0], header[2])
+	}
+	if header[1] != socks5Connect {
+		socks5Reply(conn, socks5BadCommand, nil)
+		return nil, fmt.Errorf("SOCKS5 command %d is not supported", header[1])
+	}
+	var host string
+	switch header[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(rdr, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		size, err := rdr.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		domain := make([]byte, size)
+		if _, err := io.ReadFull(rdr, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		socks5Reply(conn, socks5BadAddrType, nil)
+		return nil, fmt.Errorf("SOCKS5 address type %d is not supported", header[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(rdr, port); err != nil {
+		return nil, err
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+
+	target, err := proxy.connect(address)
+	if err != nil {
+		code := byte(socks5Unreachable)
+		var netErr net.Error
+		switch {
+		case errors.Is(err, errNotAllowed):
+			code = socks5NotAllowed
+		case errors.Is(err, syscall.ECONNREFUSED):
+			code = socks5Refused
+		case errors.As(err, &netErr) && netErr.Timeout():
+			code = socks5TimedOut
+		}
+		socks5Reply(conn, code, nil)
+		return nil, fmt.Errorf("Could not connect to %q; Details: %w", address, err)
+	}
+	if err = socks5Reply(conn, socks5Succeeded, target.LocalAddr()); err != nil {
+		target.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
+//socks5Reply sends a SOCKS5 reply with the provided code and bound address
+func socks5Reply(conn net.Conn, code byte, bound net.Addr) error {
+	reply := []byte{socks5Version, code, 0}
+	ip, port := net.IPv4zero.To4(), 0
+	if tcpAddr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = tcpAddr.IP, tcpAddr.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(append(reply, socks5AddrIPv4), ip4...)
+	} else {
+		reply = append(append(reply, socks5AddrIPv6), ip.To16()...)
+	}
+	reply = append(reply, byte(port>>8), byte(port))
+	_, err := conn.Write(reply)
+	return err
+}
+
+//httpConnect handles an HTTP CONNECT request, returning the connection to the target
+func (proxy *tunnelProxy) httpConnect(conn net.Conn, rdr *bufio.Reader) (net.Conn, error) {
+	req, err := http.ReadRequest(rdr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid HTTP CONNECT request; Details: %w", err)
+	}
+	if req.Method != http.MethodConnect {
+		httpReply(conn, http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("HTTP method %s is not supported", req.Method)
+	}
+
+	target, err := proxy.connect(req.Host)
+	if err != nil {
+		status := http.StatusBadGateway
+		var netErr net.Error
+		switch {
+		case errors.Is(err, errNotAllowed):
+			status = http.StatusForbidden
+		case errors.As(err, &netErr) && netErr.Timeout():
+			status = http.StatusGatewayTimeout
+		}
+		httpReply(conn, status)
+		return nil, fmt.Errorf("Could not connect to %q; Details: %w", req.Host, err)
+	}
+	if _, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		target.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
+//httpReply sends an HTTP error response with the provided status
+func httpReply(conn net.Conn, status int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+}
+
+//bufferedConn is a connection whose reads are buffered by rdr
+type bufferedConn struct {
+	net.Conn
+	rdr *bufio.Reader
+}
+
+func (conn bufferedConn) Read(buf []byte) (int, error) {
+	return conn.rdr.Read(buf)
+}
+
+//allowlist is the set of addresses tunnels may connect to, each entry is of the
+// form host:port where:
+//  - host is a host name, "*.domain" for any subdomain of domain, an IP, a CIDR
+//    block or "*" for any host.
+//  - port is a port number or "*" for any port.
+// Entries are matched against the address requested by the client, and IP and
+// CIDR entries also against the IPs it resolves to. The IP connected to must not
+// be a loopback, link-local or unspecified address unless an IP or CIDR entry
+// includes it, so host name entries (and "*") can't reach the gateway's own
+// services or cloud metadata endpoints (ex. 169.254.169.254).
+type allowlist []allowEntry
+
+//allowEntry is a parsed entry of an allowlist
+type allowEntry struct {
+	host    string     //Lower case host name, "*.domain" or "*", if ipNet is nil
+	ipNet   *net.IPNet //IP or CIDR block
+	anyPort bool
+	port    int
+}
+
+//String implements flag.Value
+func (list *allowlist) String() string {
+	if list == nil {
+		return ""
+	}
+	entries := make([]string, len(*list))
+	for i, entry := range *list {
+		host, port := entry.host, "*"
+		if entry.ipNet != nil {
+			host = entry.ipNet.String()
+		}
+		if !entry.anyPort {
+			port = strconv.Itoa(entry.port)
+		}
+		entries[i] = net.JoinHostPort(host, port)
+	}
+	return strings.Join(entries, ",")
+}
+
+//Set implements flag.Value by adding an entry
+func (list *allowlist) Set(value string) error {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return fmt.Errorf("Allowlist entry %q is not in the form host:port; Details: %s", value, err)
+	}
+
+	entry := allowEntry{anyPort: port == "*"}
+	if !entry.anyPort {
+		if entry.port, err = strconv.Atoi(port); err != nil || entry.port < 1 || entry.port > 65535 {
+			return fmt.Errorf("Allowlist entry %q has an invalid port", value)
+		}
+	}
+	switch _, ipNet, err := net.ParseCIDR(host); {
+	case err == nil:
+		entry.ipNet = ipNet
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := net.IPv6len * 8
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), net.IPv4len*8
+		}
+		entry.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case host == "" || strings.Contains(host[1:], "*") || (strings.HasPrefix(host, "*") && host != "*" && !strings.HasPrefix(host, "*.")):
+		return fmt.Errorf("Allowlist entry %q has an invalid host", value)
+	default:
+		entry.host = strings.ToLower(host)
+	}
+
+	*list = append(*list, entry)
+	return nil
+}
+
+//permits returns true if an entry matches the address in the form host:port
+func (list allowlist) permits(address string) bool {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+
+	for _, entry := range list {
+		if !entry.anyPort && entry.port != port {
+			continue
+		}
+		switch {
+		case entry.ipNet != nil:
+			if ip != nil && entry.ipNet.Contains(ip) {
+				return true
+			}
+		case entry.host == "*":
+			return true
+		case strings.HasPrefix(entry.host, "*."):
+			if ip == nil && strings.HasSuffix(host, entry.host[1:]) {
+				return true
+			}
+		case entry.host == host:
+			return true
+		}
+	}
+	return false
+}
+
+//hasIPEntry returns true if an IP or CIDR entry matches the port
+func (list allowlist) hasIPEntry(port int) bool {
+	for _, entry := range list {
+		if entry.ipNet != nil && (entry.anyPort || entry.port == port) {
+			return true
+		}
+	}
+	return false
+}
+
+//permitsIP returns true if the resolved IP may be connected to on the port, named
+// is true if the requested address was permitted by permits
+func (list allowlist) permitsIP(ip net.IP, port int, named bool) bool {
+	if ip == nil {
+		return false
+	}
+	for _, entry := range list {
+		if entry.ipNet != nil && (entry.anyPort || entry.port == port) && entry.ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return named && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsUnspecified()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tarndt/wasmws"
+)
+
+//newTestTunnel returns the websocket URL of a tunnel permitting the provided
+// allowlist entries and the address of an echo backend
+func newTestTunnel(t *testing.T, allowEntries ...string) (string, string) {
+	backend := newTestBackend(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+
+	proxy := &tunnelProxy{connectTimeout: time.Second, halfCloseTimeout: time.Second}
+	for _, entry := range append(allowEntries, backend) {
+		if err := proxy.allow.Set(entry); err != nil {
+			t.Fatalf("Invalid allowlist entry %q; Details: %s", entry, err)
+		}
+	}
+	return newTestListener(t, proxy.serve), backend
+}
+
+//testEcho checks that the connection echos what is written to it
+func testEcho(t *testing.T, conn io.ReadWriter) {
+	msg := []byte("Hello target")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("Could not write to tunnel; Details: %s", err)
+	}
+	reply := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != string(msg) {
+		t.Fatalf("Tunnel echoed %q rather than %q; Details: %v", reply, msg, err)
+	}
+}
+
+func TestTunnelSOCKS5(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsURL, backend := newTestTunnel(t)
+	conn, err := wasmws.DialTunnel(testCtx, wsURL, backend)
+	if err != nil {
+		t.Fatalf("Could not tunnel to %q; Details: %s", backend, err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	//Only the backend's port is allowed on its IP
+	host, _, _ := net.SplitHostPort(backend)
+	if _, err = wasmws.DialTunnel(testCtx, wsURL, net.JoinHostPort(host, "1")); !errors.Is(err, wasmws.ErrTunnelNotAllowed) {
+		t.Fatalf("Tunnel to an address not on the allowlist should fail with ErrTunnelNotAllowed, not: %v", err)
+	}
+
+	//Malformed requests are refused with a general failure
+	for _, request := range [][]byte{
+		{4, socks5Connect, 0, socks5AddrIPv4, 127, 0, 0, 1, 0, 80},             //Version
+		{socks5Version, socks5Connect, 1, socks5AddrIPv4, 127, 0, 0, 1, 0, 80}, //Reserved
+	} {
+		conn, err := wasmws.DialContext(testCtx, "websocket", wsURL)
+		if err != nil {
+			t.Fatalf("Could not dial tunnel at %q; Details: %s", wsURL, err)
+		}
+		if _, err = conn.Write(append([]byte{socks5Version, 1, socks5NoAuth}, request...)); err != nil {
+			t.Fatalf("Could not write SOCKS5 request; Details: %s", err)
+		}
+		reply := make([]byte, 2+4)
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("Could not read SOCKS5 reply; Details: %s", err)
+		}
+		if reply[3] != socks5Failure {
+			t.Fatalf("Malformed SOCKS5 request % x was answered with code %d rather than %d", request, reply[3], socks5Failure)
+		}
+		conn.Close()
+	}
+}
+
+func TestTunnelHTTPConnect(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsURL, backend := newTestTunnel(t, "*.invalid:*")
+	for _, test := range []struct {
+		target string
+		status int
+	}{
+		{target: backend, status: http.StatusOK},
+		{target: "internal.service:80", status: http.StatusForbidden},
+		{target: "unresolvable.invalid:80", status: http.StatusBadGateway},
+	} {
+		conn, err := wasmws.DialContext(testCtx, "websocket", wsURL)
+		if err != nil {
+			t.Fatalf("Could not dial tunnel at %q; Details: %s", wsURL, err)
+		}
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", test.target, test.target)
+		rdr := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(rdr, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			t.Fatalf("Could not read CONNECT response; Details: %s", err)
+		}
+		if resp.StatusCode != test.status && !(test.status == http.StatusBadGateway && resp.StatusCode == http.StatusGatewayTimeout) {
+			t.Fatalf("CONNECT to %q returned status %d rather than %d", test.target, resp.StatusCode, test.status)
+		}
+		if test.status == http.StatusOK {
+			testEcho(t, struct {
+				io.Reader
+				io.Writer
+			}{rdr, conn})
+		}
+		conn.Close()
+	}
+}
+
+func TestTunnelResolvedAddress(t *testing.T) {
+	backend := newTestBackend(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	_, port, _ := net.SplitHostPort(backend)
+
+	for _, test := range []struct {
+		allow     []string
+		target    string
+		permitted bool
+	}{
+		{allow: []string{"*:*"}, target: backend},                                     //Loopback IPs need an IP entry
+		{allow: []string{"localhost:*"}, target: net.JoinHostPort("localhost", port)}, //Even when requested by name
+		{allow: []string{"*:*"}, target: net.JoinHostPort("0.0.0.0", port)},
+		{allow: []string{"*:*"}, target: "169.254.169.254:80"},
+		{allow: []string{"localhost:*", backend}, target: net.JoinHostPort("localhost", port), permitted: true},
+		{allow: []string{"127.0.0.0/8:*"}, target: net.JoinHostPort("localhost", port), permitted: true}, //CIDR entries match resolved IPs
+	} {
+		proxy := &tunnelProxy{connectTimeout: time.Second}
+		for _, entry := range test.allow {
+			if err := proxy.allow.Set(entry); err != nil {
+				t.Fatalf("Invalid allowlist entry %q; Details: %s", entry, err)
+			}
+		}
+		conn, err := proxy.connect(test.target)
+		if !test.permitted {
+			if !errors.Is(err, errNotAllowed) {
+				t.Fatalf("Allowlist %s should not have permitted %q, error: %v", proxy.allow.String(), test.target, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Allowlist %s should have permitted %q; Details: %s", proxy.allow.String(), test.target, err)
+		}
+		testEcho(t, conn)
+		conn.Close()
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	var allow allowlist
+	for _, entry := range []string{"db.internal:5432", "*.cache.internal:*", "10.0.0.0/8:443", "[::1]:80", "Mixed.Case:1"} {
+		if err := allow.Set(entry); err != nil {
+			t.Fatalf("Valid allowlist entry %q was rejected; Details: %s", entry, err)
+		}
+	}
+	for _, entry := range []string{"db.internal", "db.internal:0", "db.internal:port", "db.*.internal:1", "*cache:1", ":1"} {
+		if err := allow.Set(entry); err == nil {
+			t.Fatalf("Invalid allowlist entry %q was accepted", entry)
+		}
+	}
+
+	for address, permitted := range map[string]bool{
+		"db.internal:5432":          true,
+		"DB.internal.:5432":         true,
+		"db.internal:5433":          false,
+		"other.internal:5432":       false,
+		"redis.cache.internal:6379": true,
+		"cache.internal:6379":       false,
+		"evilcache.internal:6379":   false,
+		"10.1.2.3:443":              true,
+		"10.1.2.3:80":               false,
+		"11.1.2.3:443":              false,
+		"[::1]:80":                  true,
+		"mixed.case:1":              true,
+		"invalid":                   false,
+	} {
+		if allow.permits(address) != permitted {
+			t.Fatalf("Allowlist %s permitted %q: %t", allow.String(), address, !permitted)
+		}
+	}
+}
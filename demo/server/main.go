@@ -46,7 +46,7 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to contruct gRPC TSL credentials from {cert,key}.pem: %s", err)
 	}
-	grpcServer := grpc.NewServer(grpc.Creds(creds))
+	grpcServer := grpc.NewServer(grpc.Creds(wasmws.GRPCServerCredentials(creds)))
 	pb.RegisterGreeterServer(grpcServer, new(helloServer))
 	//Run gRPC server
 	go func() {
@@ -0,0 +1,104 @@
+package wasmws
+
+import (
+	"context"
+	"net"
+)
+
+//Dial is a standard legacy network dialer that returns a websocket-based connection.
+//See: DialContext for details on the network and address.
+func Dial(network, address string) (net.Conn, error) {
+	return DialContext(context.Background(), network, address)
+}
+
+//DialContext is a standard context-aware network dialer that returns a websocket-based connection.
+// The address is a URL that should be in the form of "ws://host/path..." for unsecured websockets
+// and "wss://host/path..." for secured websockets. In a web browser (WASM) the browser provided
+// websocket is used: If tunnel a TLS based protocol over a "wss://..." websocket you will get TLS
+// twice, once on the websocket using the browsers TLS stack and another using the Go (or other
+// compiled) TLS stack. Native (non-WASM) applications use nhooyr.io/websocket instead, which allows
+// the same client code to connect to a WebSockListener from both a web browser and a native application.
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+//GRPCDialer is a helper that can be used with grpc.WithContextDialer to call DialContext.
+//The address provided to the calling grpc.Dial should be in the form "passthrough:///"+websocketURL
+// where websocketURL matches the description in DialContext.
+func GRPCDialer(ctx context.Context, address string) (net.Conn, error) {
+	return DialContext(ctx, "websocket", address)
+}
+
+//DialResumable dials a resumable connection to a WebSockListener that has
+// resumable sessions enabled (see: ListenerOptions.Resume) using DialContext.
+// If the websocket is lost it is transparently redialed and the session resumed
+// without losing data; Reads and writes wait while this occurs. If the session
+// cannot be resumed before the timeout, operations return ErrSessionExpired.
+// The options may be nil to use the defaults.
+func DialResumable(ctx context.Context, address string, opts *ResumeOptions) (net.Conn, error) {
+	var dialer Dialer
+	return dialer.DialResumable(ctx, address, opts)
+}
+
+//Dialer contains options for dialing websocket connections, the zero value is
+// equivalent to the package level DialContext. A Dialer may be used concurrently
+// to dial any number of connections, so different connections in an application
+// can be tuned differently. Fields documented as browser only are ignored by
+// native (non-WASM) applications.
+type Dialer struct {
+	//Subprotocols are advertised to the server in order of preference (via the
+	// Sec-WebSocket-Protocol header); See: WebSocket.Protocol
+	Subprotocols []string
+
+	//MessageType is the type of messages sent by Write, it defaults to
+	// MessageBinary; See: WebSocket.SetMessageType
+	MessageType MessageType
+
+	//ReadLimit is the maximum size in bytes of a single received message, if
+	// zero no limit is enforced so ReadMessage buffers messages of any size the
+	// server sends. A connection receiving a larger message is closed and reads
+	// return an error matching ErrMessageTooBig; See: WebSocket.SetReadLimit
+	ReadLimit int64
+
+	//DisableBlobStreaming prevents the browser provided Websocket's Blob
+	// streaming interface from being used, regardless of EnableBlobStreaming.
+	// (Browser only)
+	DisableBlobStreaming bool
+
+	//StreamThreshold is the message size in bytes above which the Blob streaming
+	// interface is used to receive messages rather than ArrayBuffers, if zero it
+	// defaults to 1024. (Browser only)
+	StreamThreshold int
+
+	//ReadQueueDepth is the number of received messages that are queued for Read
+	// before additional messages wait in goroutines, if zero it defaults to 8.
+	// (Browser only)
+	ReadQueueDepth int
+
+	//WriteHighWaterMark and WriteLowWaterMark override the package level
+	// defaults of the same names if non-zero, a negative high-water mark disables
+	// backpressure. (Browser only)
+	WriteHighWaterMark int
+	WriteLowWaterMark  int
+
+	//Logger, if set, receives diagnostic events of dialed connections
+	Logger Logger
+}
+
+//GRPCDialer is a helper that can be used with grpc.WithContextDialer to call the
+// Dialer's DialContext; See: the package level GRPCDialer for details.
+func (d *Dialer) GRPCDialer(ctx context.Context, address string) (net.Conn, error) {
+	return d.DialContext(ctx, "websocket", address)
+}
+
+//DialResumable is DialResumable using the Dialer's options for every websocket
+// of the session; See: the package level DialResumable for details.
+func (d *Dialer) DialResumable(ctx context.Context, address string, opts *ResumeOptions) (net.Conn, error) {
+	if err := checkDialArgs("websocket", address); err != nil {
+		return nil, err
+	}
+	return dialResumable(ctx, opts, func(ctx context.Context) (net.Conn, error) {
+		return d.DialContext(ctx, "websocket", address)
+	})
+}
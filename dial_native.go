@@ -0,0 +1,53 @@
+// +build !js,!wasm
+
+package wasmws
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"nhooyr.io/websocket"
+)
+
+//DialContext is a standard context-aware network dialer that returns a websocket-based
+// connection using the Dialer's options; See: the package level DialContext for details.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := checkDialArgs(network, address); err != nil {
+		return nil, err
+	}
+
+	ws, resp, err := websocket.Dial(ctx, address, &websocket.DialOptions{Subprotocols: d.Subprotocols})
+	if err != nil {
+		return nil, fmt.Errorf("WebSocket: Could not dial %q; Details: %w", address, err)
+	}
+	loggerOrNop(d.Logger).Debug("WebSocket: Opened", "url", address, "protocol", ws.Subprotocol())
+
+	//The dial context only bounds dialing, not the lifetime of the connection
+	streamType := MessageBinary
+	if d.MessageType == MessageText {
+		streamType = MessageText
+	}
+	stream := newWSStream(context.Background(), ws, streamType)
+	stream.counters.compressed = deflateNegotiated(resp.Header.Get("Sec-WebSocket-Extensions"))
+	stream.setReadLimit(d.ReadLimit)
+	return &dialConn{wsStream: stream, addr: wsAddr(address)}, nil
+}
+
+//dialConn is a net.Conn returned by the native DialContext, like the browser
+// implementation it reports the websocket URL as both of its addresses and
+// provides ReadMessage and WriteMessage
+type dialConn struct {
+	*wsStream
+	addr wsAddr
+}
+
+//LocalAddr returns the websocket URL, see: wsAddr
+func (conn *dialConn) LocalAddr() net.Addr {
+	return conn.addr
+}
+
+//RemoteAddr returns the websocket URL, see: wsAddr
+func (conn *dialConn) RemoteAddr() net.Addr {
+	return conn.addr
+}
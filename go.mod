@@ -1,10 +1,16 @@
 module github.com/tarndt/wasmws
 
-go 1.13
+go 1.18
 
 require (
-	github.com/gobwas/ws v1.1.0 // indirect
-	golang.org/x/sys v0.0.0-20211003122950-b1ebd4e1001c // indirect
+	golang.org/x/net v0.23.0
 	google.golang.org/grpc v1.26.0
-	nhooyr.io/websocket v1.7.4
+	nhooyr.io/websocket v1.8.10
+)
+
+require (
+	github.com/golang/protobuf v1.3.2 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/genproto v0.0.0-20190819201941-24fa4b261c55 // indirect
 )
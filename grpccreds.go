@@ -0,0 +1,131 @@
+// +build !js,!wasm
+
+package wasmws
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+//GRPCAuthInfo is the gRPC credentials.AuthInfo of connections accepted by a
+// WebSockListener when served using GRPCServerCredentials
+type GRPCAuthInfo struct {
+	//AuthInfo is the AuthInfo of the wrapped credentials, ex. credentials.TLSInfo,
+	// it is nil if no transport security is being used
+	credentials.AuthInfo
+
+	//Request is the HTTP request that was upgraded to the websocket; See: WebSockConn.Request
+	Request *http.Request
+
+	//Identity is the identity attached by the listener's Authenticator; See: WebSockConn.Identity
+	Identity interface{}
+}
+
+//AuthType returns the auth type of the wrapped credentials or "websocket"
+func (info GRPCAuthInfo) AuthType() string {
+	if info.AuthInfo == nil {
+		return "websocket"
+	}
+	return info.AuthInfo.AuthType()
+}
+
+//grpcServerCreds is a credentials.TransportCredentials that attaches the upgrade
+// request of accepted websockets to the AuthInfo of the wrapped credentials
+type grpcServerCreds struct {
+	credentials.TransportCredentials
+}
+
+//GRPCServerCredentials wraps the provided gRPC transport credentials (ex.
+// credentials.NewTLS) so that the HTTP upgrade request of each connection is
+// available to gRPC handlers and interceptors via peer.FromContext as a
+// GRPCAuthInfo; See: GRPCUpgradeRequest. If creds is nil, no transport security
+// is used. Use this with grpc.Creds when serving a WebSockListener.
+func GRPCServerCredentials(creds credentials.TransportCredentials) credentials.TransportCredentials {
+	return grpcServerCreds{TransportCredentials: creds}
+}
+
+//ServerHandshake performs the handshake of the wrapped credentials (if any) and
+// returns a GRPCAuthInfo
+func (creds grpcServerCreds) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, info := rawConn, credentials.AuthInfo(nil)
+	if creds.TransportCredentials != nil {
+		var err error
+		if conn, info, err = creds.TransportCredentials.ServerHandshake(rawConn); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	authInfo := GRPCAuthInfo{AuthInfo: info}
+	if wsConn, ok := unwrapWebSockConn(rawConn); ok {
+		authInfo.Request, authInfo.Identity = wsConn.Request(), wsConn.Identity()
+	}
+	return conn, authInfo, nil
+}
+
+//ClientHandshake performs the client handshake of the wrapped credentials (if any)
+func (creds grpcServerCreds) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	if creds.TransportCredentials == nil {
+		return rawConn, nil, nil
+	}
+	return creds.TransportCredentials.ClientHandshake(ctx, authority, rawConn)
+}
+
+//Info returns the ProtocolInfo of the wrapped credentials (if any)
+func (creds grpcServerCreds) Info() credentials.ProtocolInfo {
+	if creds.TransportCredentials == nil {
+		return credentials.ProtocolInfo{SecurityProtocol: "websocket"}
+	}
+	return creds.TransportCredentials.Info()
+}
+
+//Clone returns a copy of these credentials
+func (creds grpcServerCreds) Clone() credentials.TransportCredentials {
+	if creds.TransportCredentials == nil {
+		return creds
+	}
+	return grpcServerCreds{TransportCredentials: creds.TransportCredentials.Clone()}
+}
+
+//OverrideServerName overrides the server name of the wrapped credentials (if any)
+func (creds grpcServerCreds) OverrideServerName(serverName string) error {
+	if creds.TransportCredentials == nil {
+		return nil
+	}
+	return creds.TransportCredentials.OverrideServerName(serverName)
+}
+
+//GRPCUpgradeRequest returns the HTTP upgrade request of the websocket the gRPC
+// call in the provided context arrived on; The server must have been
+// constructed with GRPCServerCredentials.
+func GRPCUpgradeRequest(ctx context.Context) (*http.Request, bool) {
+	info, ok := grpcAuthInfo(ctx)
+	if !ok || info.Request == nil {
+		return nil, false
+	}
+	return info.Request, true
+}
+
+//GRPCIdentity returns the identity the listener's Authenticator attached to the
+// websocket the gRPC call in the provided context arrived on; The server must have
+// been constructed with GRPCServerCredentials.
+func GRPCIdentity(ctx context.Context) (interface{}, bool) {
+	info, ok := grpcAuthInfo(ctx)
+	if !ok || info.Identity == nil {
+		return nil, false
+	}
+	return info.Identity, true
+}
+
+//grpcAuthInfo returns the GRPCAuthInfo of the peer in the provided context
+func grpcAuthInfo(ctx context.Context) (GRPCAuthInfo, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return GRPCAuthInfo{}, false
+	}
+	info, ok := p.AuthInfo.(GRPCAuthInfo)
+	return info, ok
+}
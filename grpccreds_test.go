@@ -0,0 +1,77 @@
+// +build !js,!wasm
+
+package wasmws
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+func TestGRPCServerCredentials(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsl, wsURL := newTestListener(t, ListenerOptions{
+		Authenticate: func(req *http.Request) (interface{}, error) {
+			return req.URL.Query().Get("user"), nil
+		},
+	})
+	client, err := DialContext(testCtx, "websocket", wsURL+"/grpc?user=test")
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	defer client.Close()
+	server, err := wsl.Accept()
+	if err != nil {
+		t.Fatalf("Could not accept test connection; Details: %s", err)
+	}
+	defer func() {
+		go io.Copy(ioutil.Discard, client) //Respond to the closing handshake
+		server.Close()
+	}()
+
+	//The upgrade request and identity of websockets are attached to the AuthInfo
+	creds := GRPCServerCredentials(nil)
+	if protocol := creds.Info().SecurityProtocol; protocol != "websocket" {
+		t.Fatalf("Credentials without transport security reported protocol %q rather than %q", protocol, "websocket")
+	}
+	conn, info, err := creds.ServerHandshake(server)
+	if err != nil {
+		t.Fatalf("Server handshake failed; Details: %s", err)
+	}
+	if conn != server {
+		t.Fatalf("Server handshake without transport security should return the connection unchanged")
+	}
+	if authType := info.AuthType(); authType != "websocket" {
+		t.Fatalf("AuthInfo reported auth type %q rather than %q", authType, "websocket")
+	}
+	ctx := peer.NewContext(testCtx, &peer.Peer{Addr: server.RemoteAddr(), AuthInfo: info})
+	if req, ok := GRPCUpgradeRequest(ctx); !ok || req.URL.Path != "/grpc" {
+		t.Fatalf("GRPCUpgradeRequest returned %v, %t rather than the upgrade request", req, ok)
+	}
+	if identity, ok := GRPCIdentity(ctx); !ok || identity != "test" {
+		t.Fatalf("GRPCIdentity returned %v, %t rather than %q", identity, ok, "test")
+	}
+
+	//Other connections have neither
+	pipeConn, _ := net.Pipe()
+	defer pipeConn.Close()
+	if _, info, err = creds.ServerHandshake(pipeConn); err != nil {
+		t.Fatalf("Server handshake of a connection that is not a websocket failed; Details: %s", err)
+	}
+	ctx = peer.NewContext(testCtx, &peer.Peer{AuthInfo: info})
+	if _, ok := GRPCUpgradeRequest(ctx); ok {
+		t.Fatalf("GRPCUpgradeRequest should not return a request for a connection that is not a websocket")
+	}
+	if _, ok := GRPCIdentity(testCtx); ok {
+		t.Fatalf("GRPCIdentity should not return an identity for a context without a peer")
+	}
+}
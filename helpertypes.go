@@ -0,0 +1,36 @@
+package wasmws
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//timeoutErr is a net.Addr implementation for the websocket to use when fufilling
+// the net.Conn interface
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "deadline exceeded" }
+
+func (timeoutError) Timeout() bool { return true }
+
+func (timeoutError) Temporary() bool { return true }
+
+//wsAddr is a net.Addr implementation for the websocket to use when fufilling
+// the net.Conn and net.Listener interfaces; It is the websocket URL.
+type wsAddr string
+
+func (wsAddr) Network() string { return "websocket" }
+
+func (url wsAddr) String() string { return string(url) }
+
+//checkDialArgs validates the network and address passed to a DialContext
+func checkDialArgs(network, address string) error {
+	if network != "websocket" {
+		return fmt.Errorf("Invalid network: %q; Details: Only \"websocket\" network is supported", network)
+	}
+	if !(strings.HasPrefix(address, "ws://") || strings.HasPrefix(address, "wss://")) {
+		return errors.New("Invalid address: websocket address should be a websocket URL that starts with ws:// or wss://")
+	}
+	return nil
+}
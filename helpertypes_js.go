@@ -1,6 +1,7 @@
 package wasmws
 
 import (
+	"io"
 	"syscall/js"
 )
 
@@ -9,20 +10,9 @@ var (
 	uint8Array  = js.Global().Get("Uint8Array")
 )
 
-//timeoutErr is a net.Addr implementation for the websocket to use when fufilling
-// the net.Conn interface
-type timeoutError struct{}
-
-func (timeoutError) Error() string { return "deadline exceeded" }
-
-func (timeoutError) Timeout() bool { return true }
-
-func (timeoutError) Temporary() bool { return true }
-
-//wsAddr is a net.Addr implementation for the websocket to use when fufilling
-// the net.Conn interface
-type wsAddr string
-
-func (wsAddr) Network() string { return "websocket" }
-
-func (url wsAddr) String() string { return string(url) }
+//jsMessage is a message received by the browser's websocket, it is queued by
+// handleMessage and consumed by Read and ReadMessage
+type jsMessage struct {
+	typ MessageType
+	rdr io.Reader
+}
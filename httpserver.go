@@ -0,0 +1,145 @@
+// +build !js,!wasm
+
+package wasmws
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+//HTTPServer is an http.Server that serves HTTP/1.1 and HTTP/2 without TLS (h2c)
+// on the connections accepted by a listener such as a WebSockListener; Clients
+// send requests using NewHTTPTransport.
+type HTTPServer struct {
+	*http.Server
+}
+
+//NewHTTPServer returns an HTTPServer for the provided handler, ex.:
+//	go wasmws.NewHTTPServer(handler).Serve(wsl)
+// The embedded http.Server may be customized before it is used, ex. to set
+// timeouts, and is stopped using its Shutdown or Close methods.
+func NewHTTPServer(handler http.Handler) *HTTPServer {
+	return &HTTPServer{Server: &http.Server{Handler: h2c.NewHandler(handler, new(http2.Server))}}
+}
+
+//Serve serves requests on the connections accepted by the listener until it
+// fails; See: http.Server.Serve
+func (srv *HTTPServer) Serve(ln net.Listener) error {
+	return srv.Server.Serve(httpListener{ln})
+}
+
+//httpListener wraps the connections accepted by a listener in httpConns
+type httpListener struct {
+	net.Listener
+}
+
+func (ln httpListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newHTTPConn(conn), nil
+}
+
+//httpConn reads from a connection in the background so read deadlines can
+// expire without interrupting a read in progress. This is required as a
+// websocket read interrupted by a deadline closes the websocket, but the HTTP
+// server does so routinely to abort the background read it performs while
+// handlers run. Only one buffer of data is read ahead, preserving backpressure.
+type httpConn struct {
+	net.Conn
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	buf          []byte //Data read but not yet consumed
+	pending      []byte //Unconsumed portion of buf
+	err          error  //The error that ended background reads
+	closed       bool
+	readDeadline deadline
+}
+
+//newHTTPConn returns an httpConn and starts its background reads
+func newHTTPConn(conn net.Conn) *httpConn {
+	hc := &httpConn{Conn: conn, buf: make([]byte, 32*1024)}
+	hc.cond = sync.NewCond(&hc.mu)
+	go hc.readLoop()
+	return hc
+}
+
+//readLoop reads from the connection into buf whenever it has been consumed
+func (hc *httpConn) readLoop() {
+	for {
+		n, err := hc.Conn.Read(hc.buf)
+
+		hc.mu.Lock()
+		hc.pending, hc.err = hc.buf[:n], err
+		hc.cond.Broadcast()
+		for len(hc.pending) > 0 && !hc.closed {
+			hc.cond.Wait()
+		}
+		done := hc.err != nil || hc.closed
+		hc.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+//Read implements the standard io.Reader interface (typical semantics)
+func (hc *httpConn) Read(buf []byte) (int, error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	for len(hc.pending) < 1 {
+		switch {
+		case hc.closed:
+			return 0, net.ErrClosed
+		case hc.err != nil:
+			return 0, hc.err
+		case hc.readDeadline.expired:
+			return 0, timeoutError{}
+		}
+		hc.cond.Wait()
+	}
+
+	n := copy(buf, hc.pending)
+	hc.pending = hc.pending[n:]
+	if len(hc.pending) < 1 {
+		hc.cond.Broadcast() //Resume background reads
+	}
+	return n, nil
+}
+
+//Close closes the connection and stops background reads
+func (hc *httpConn) Close() error {
+	hc.mu.Lock()
+	hc.closed = true
+	hc.readDeadline.set(time.Time{}, nil)
+	hc.cond.Broadcast()
+	hc.mu.Unlock()
+	return hc.Conn.Close()
+}
+
+//SetDeadline implements the Conn SetDeadline method
+func (hc *httpConn) SetDeadline(future time.Time) error {
+	hc.SetReadDeadline(future)
+	return hc.Conn.SetWriteDeadline(future)
+}
+
+//SetReadDeadline implements the Conn SetReadDeadline method
+func (hc *httpConn) SetReadDeadline(future time.Time) error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.readDeadline.set(future, hc.cond)
+	return nil
+}
+
+//NetConn returns the wrapped connection
+func (hc *httpConn) NetConn() net.Conn {
+	return hc.Conn
+}
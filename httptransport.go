@@ -0,0 +1,94 @@
+package wasmws
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+//HTTPTransportOptions configures the http.RoundTripper returned by NewHTTPTransport,
+// the zero value uses the defaults
+type HTTPTransportOptions struct {
+	//Dialer dials the websockets, if nil the package level DialContext is used
+	Dialer *Dialer
+
+	//H2C sends requests using HTTP/2 without TLS ("http://..." URLs only), all
+	// concurrent requests then share a single websocket. The server must support
+	// HTTP/2 with prior knowledge, as servers returned by NewHTTPServer do.
+	H2C bool
+
+	//MaxConns is the maximum number of websockets open at once when using
+	// HTTP/1.1, further requests wait for one to become available. Defaults to 6.
+	MaxConns int
+
+	//IdleTimeout is how long an idle websocket is kept for reuse, defaults to 5
+	// minutes
+	IdleTimeout time.Duration
+
+	//DialTimeout bounds opening each websocket, defaults to 30 seconds
+	DialTimeout time.Duration
+}
+
+const (
+	defaultHTTPMaxConns    = 6
+	defaultHTTPIdleTimeout = time.Minute * 5
+	defaultHTTPDialTimeout = time.Second * 30
+)
+
+//NewHTTPTransport returns an http.RoundTripper that sends requests over websockets
+// dialed to the provided URL, ex. to reach services behind a WebSockListener
+// served using NewHTTPServer from a browser without the CORS restrictions of the
+// fetch API. Requests may use any URL: The URL's host is sent as usual but every
+// request is sent to the server at wsURL. Since opening a websocket is far more
+// expensive than a TCP connection, idle websockets are kept longer and in greater
+// number than by http.DefaultTransport. The options may be nil to use the
+// defaults.
+func NewHTTPTransport(wsURL string, opts *HTTPTransportOptions) http.RoundTripper {
+	if opts == nil {
+		opts = new(HTTPTransportOptions)
+	}
+	dialer, dialTimeout := opts.Dialer, opts.DialTimeout
+	if dialer == nil {
+		dialer = new(Dialer)
+	}
+	if dialTimeout <= 0 {
+		dialTimeout = defaultHTTPDialTimeout
+	}
+	dial := func(ctx context.Context) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+		return dialer.DialContext(ctx, "websocket", wsURL)
+	}
+
+	maxConns, idleTimeout := opts.MaxConns, opts.IdleTimeout
+	if maxConns <= 0 {
+		maxConns = defaultHTTPMaxConns
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = defaultHTTPIdleTimeout
+	}
+
+	if opts.H2C {
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dial(ctx)
+			},
+			IdleConnTimeout: idleTimeout,
+		}
+	}
+
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx)
+		},
+		MaxConnsPerHost:     maxConns,
+		MaxIdleConns:        maxConns,
+		MaxIdleConnsPerHost: maxConns,
+		IdleConnTimeout:     idleTimeout,
+	}
+}
@@ -0,0 +1,66 @@
+// +build !js,!wasm
+
+package wasmws
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		opts     *HTTPTransportOptions
+		proto    string
+		maxConns int64
+	}{
+		{name: "HTTP/1.1", opts: nil, proto: "HTTP/1.1", maxConns: defaultHTTPMaxConns},
+		{name: "H2C", opts: &HTTPTransportOptions{H2C: true}, proto: "HTTP/2.0", maxConns: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			wsl, wsURL := newTestListener(t, ListenerOptions{})
+			server := NewHTTPServer(http.HandlerFunc(func(wtr http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				fmt.Fprintf(wtr, "%s %s %s %s", req.Proto, req.Host, req.URL.Path, body)
+			}))
+			go server.Serve(wsl)
+			defer server.Close()
+
+			client := &http.Client{Transport: NewHTTPTransport(wsURL, test.opts)}
+			defer client.CloseIdleConnections()
+
+			const requestCount = 20
+			var wg sync.WaitGroup
+			errCh := make(chan error, requestCount)
+			for i := 0; i < requestCount; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					resp, err := client.Post(fmt.Sprintf("http://internal.service/path%d", i), "text/plain", strings.NewReader("body"))
+					if err != nil {
+						errCh <- fmt.Errorf("Request failed; Details: %w", err)
+						return
+					}
+					defer resp.Body.Close()
+					reply, err := ioutil.ReadAll(resp.Body)
+					if expected := fmt.Sprintf("%s internal.service /path%d body", test.proto, i); err != nil || string(reply) != expected {
+						errCh <- fmt.Errorf("Response was %q rather than %q; Details: %v", reply, expected, err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			close(errCh)
+			for err := range errCh {
+				t.Fatal(err)
+			}
+
+			if accepted := wsl.Stats().Accepted; accepted < 1 || accepted > test.maxConns {
+				t.Fatalf("Requests used %d websockets rather than at most %d", accepted, test.maxConns)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package wasmws
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+//Logger receives diagnostic events as a message and alternating key-value
+// pairs, its method set matches that of *slog.Logger (log/slog) so one can be
+// used directly.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+//nopLogger is the Logger used when none is provided, it discards all events
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+
+func (nopLogger) Info(string, ...interface{}) {}
+
+func (nopLogger) Warn(string, ...interface{}) {}
+
+func (nopLogger) Error(string, ...interface{}) {}
+
+//loggerOrNop returns the provided logger or a nopLogger if it is nil
+func loggerOrNop(logger Logger) Logger {
+	if logger == nil {
+		return nopLogger{}
+	}
+	return logger
+}
+
+//stdLogger is the Logger used by WebSockListener when none is provided, it
+// writes warnings and errors using the standard log package
+type stdLogger struct{}
+
+func (stdLogger) Debug(string, ...interface{}) {}
+
+func (stdLogger) Info(string, ...interface{}) {}
+
+func (stdLogger) Warn(msg string, args ...interface{}) { logStd("WARN", msg, args) }
+
+func (stdLogger) Error(msg string, args ...interface{}) { logStd("ERROR", msg, args) }
+
+//logStd writes an event using the standard log package, ex. "ERROR: WebSockListener:
+// Could not accept websocket remoteAddr=192.0.2.1:1234 err=..."
+func logStd(level, msg string, args []interface{}) {
+	var line strings.Builder
+	line.WriteString(level + ": " + msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 < len(args) {
+			fmt.Fprintf(&line, " %v=%v", args[i], args[i+1])
+		} else {
+			fmt.Fprintf(&line, " %v", args[i])
+		}
+	}
+	log.Print(line.String())
+}
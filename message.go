@@ -0,0 +1,83 @@
+package wasmws
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+//MessageType is the type of a websocket message, its values are the websocket
+// opcodes of the message types (RFC 6455); See: ReadMessage and WriteMessage
+type MessageType int
+
+const (
+	MessageText   MessageType = 1 //MessageText is a UTF-8 encoded text message
+	MessageBinary MessageType = 2 //MessageBinary is a binary message
+)
+
+//ErrMessageTooBig is returned by reads when a received message exceeds the read
+// limit (see: ListenerOptions.ReadLimit and Dialer.ReadLimit), errors.Is can be
+// used to detect it. The websocket is closed.
+var ErrMessageTooBig = errors.New("WebSocket: Message is too big")
+
+//ErrInvalidUTF8 is returned when a text message that is not valid UTF-8 is
+// written or received, errors.Is can be used to detect it.
+var ErrInvalidUTF8 = errors.New("WebSocket: Text message is not valid UTF-8")
+
+func (typ MessageType) String() string {
+	switch typ {
+	case MessageText:
+		return "text"
+	case MessageBinary:
+		return "binary"
+	default:
+		return fmt.Sprintf("MessageType(%d)", int(typ))
+	}
+}
+
+//utf8Validator incrementally validates a text message that is received in
+// chunks, runes may be split between chunks
+type utf8Validator struct {
+	partial  [utf8.UTFMax]byte //The start of a rune split at the end of the last chunk
+	nPartial int
+}
+
+//reset prepares the validator for a new message
+func (v *utf8Validator) reset() {
+	v.nPartial = 0
+}
+
+//valid returns true if the provided chunk continues the message with valid
+// UTF-8, final should be true for the last chunk of the message
+func (v *utf8Validator) valid(chunk []byte, final bool) bool {
+	//Complete the rune split by the last chunk
+	if v.nPartial > 0 {
+		need := utf8.UTFMax - v.nPartial
+		if need > len(chunk) {
+			need = len(chunk)
+		}
+		buf := append(v.partial[:v.nPartial:v.nPartial], chunk[:need]...)
+		if !utf8.FullRune(buf) {
+			v.nPartial = copy(v.partial[:], buf)
+			return !final
+		}
+		r, size := utf8.DecodeRune(buf)
+		if r == utf8.RuneError && size == 1 {
+			return false
+		}
+		chunk = chunk[size-v.nPartial:]
+		v.nPartial = 0
+	}
+
+	//Hold back a rune split at the end of this chunk
+	for i := len(chunk) - 1; i >= 0 && i >= len(chunk)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(chunk[i]) {
+			if !utf8.FullRune(chunk[i:]) {
+				v.nPartial = copy(v.partial[:], chunk[i:])
+				chunk = chunk[:i]
+			}
+			break
+		}
+	}
+	return utf8.Valid(chunk) && !(final && v.nPartial > 0)
+}
@@ -0,0 +1,40 @@
+package wasmws
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestUTF8Validator(t *testing.T) {
+	valid := []byte("ascii, ünïcödé, 世界 and 🌍!")
+	for _, testCase := range []struct {
+		msg   []byte
+		valid bool
+	}{
+		{valid, true},
+		{[]byte{}, true},
+		{[]byte("bad \xff byte"), false},
+		{[]byte("truncated \xe4\xb8"), false},
+		{[]byte("surrogate \xed\xa0\x80"), false},
+		{[]byte("overlong \xc0\xaf"), false},
+	} {
+		if valid := utf8.Valid(testCase.msg); valid != testCase.valid {
+			t.Fatalf("Test case %q should be valid: %t", testCase.msg, testCase.valid)
+		}
+
+		//Every way of splitting the message into chunks must agree with utf8.Valid
+		for chunkSize := 1; chunkSize <= len(testCase.msg)+1; chunkSize++ {
+			var validator utf8Validator
+			valid, msg := true, testCase.msg
+			for valid && len(msg) > chunkSize {
+				valid, msg = validator.valid(msg[:chunkSize], false), msg[chunkSize:]
+			}
+			if valid {
+				valid = validator.valid(msg, true)
+			}
+			if valid != testCase.valid {
+				t.Fatalf("Validating %q in chunks of %d bytes reported valid: %t", testCase.msg, chunkSize, valid)
+			}
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// +build !js,!wasm
+
+package wasmws
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Reasons reported to MetricsCollector.UpgradeFailed
+const (
+	FailureShutdown     = "shutdown"     //FailureShutdown is a request received after the listener was closed
+	FailureUnauthorized = "unauthorized" //FailureUnauthorized is a request rejected by the Authenticator
+	FailureUpgrade      = "upgrade"      //FailureUpgrade is a request that could not be upgraded to a websocket
+	FailureSession      = "session"      //FailureSession is a websocket that could not start or resume a session
+	FailureNotAccepted  = "not_accepted" //FailureNotAccepted is a websocket not accepted before it was abandoned
+
+	FailureOverloaded    = "overloaded"     //FailureOverloaded is a request refused due to ListenerOptions.MaxConnections
+	FailureAcceptTimeout = "accept_timeout" //FailureAcceptTimeout is a websocket not accepted within ListenerOptions.AcceptTimeout
+)
+
+//MetricsCollector receives the events of a WebSockListener needed to maintain
+// metrics; See: ListenerOptions.Metrics. Its methods are called concurrently and
+// must not block. ExpvarMetrics and PrometheusMetrics are provided.
+type MetricsCollector interface {
+	UpgradeAttempted()                       //An HTTP request was received
+	UpgradeFailed(reason string)             //An HTTP request did not result in an accepted connection, see: the Failure... constants
+	ConnectionOpened()                       //A websocket was upgraded
+	ConnectionClosed(lifetime time.Duration) //An upgraded websocket was closed
+	AcceptQueueDepth(depth int)              //The number of connections waiting for Accept changed
+	BytesReceived(n int)                     //Message payload bytes were received
+	BytesSent(n int)                         //Message payload bytes were sent
+}
+
+//nopMetrics is the MetricsCollector used when none is provided
+type nopMetrics struct{}
+
+func (nopMetrics) UpgradeAttempted() {}
+
+func (nopMetrics) UpgradeFailed(string) {}
+
+func (nopMetrics) ConnectionOpened() {}
+
+func (nopMetrics) ConnectionClosed(time.Duration) {}
+
+func (nopMetrics) AcceptQueueDepth(int) {}
+
+func (nopMetrics) BytesReceived(int) {}
+
+func (nopMetrics) BytesSent(int) {}
+
+//ExpvarMetrics is a MetricsCollector that publishes metrics using the expvar
+// package, they are served as JSON by expvar's handler (/debug/vars)
+type ExpvarMetrics struct {
+	upgradeAttempts, connectionsOpened, connectionsClosed expvar.Int
+	activeConnections, acceptQueueDepth                   expvar.Int
+	bytesReceived, bytesSent                              expvar.Int
+	upgradeFailures                                       expvar.Map
+	connectionSeconds                                     expvar.Float
+}
+
+var _ MetricsCollector = (*ExpvarMetrics)(nil)
+
+//NewExpvarMetrics returns an ExpvarMetrics published as an expvar.Map with the
+// provided name, like expvar.Publish it panics if the name is already in use.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	em := new(ExpvarMetrics)
+	em.upgradeFailures.Init()
+
+	vars := expvar.NewMap(name)
+	vars.Set("upgrade_attempts", &em.upgradeAttempts)
+	vars.Set("upgrade_failures", &em.upgradeFailures)
+	vars.Set("connections_opened", &em.connectionsOpened)
+	vars.Set("connections_closed", &em.connectionsClosed)
+	vars.Set("connection_seconds", &em.connectionSeconds)
+	vars.Set("active_connections", &em.activeConnections)
+	vars.Set("accept_queue_depth", &em.acceptQueueDepth)
+	vars.Set("bytes_received", &em.bytesReceived)
+	vars.Set("bytes_sent", &em.bytesSent)
+	return em
+}
+
+//UpgradeAttempted counts an HTTP request received
+func (em *ExpvarMetrics) UpgradeAttempted() { em.upgradeAttempts.Add(1) }
+
+//UpgradeFailed counts a request that was not accepted by reason
+func (em *ExpvarMetrics) UpgradeFailed(reason string) { em.upgradeFailures.Add(reason, 1) }
+
+//ConnectionOpened counts an upgraded websocket as opened and active
+func (em *ExpvarMetrics) ConnectionOpened() {
+	em.connectionsOpened.Add(1)
+	em.activeConnections.Add(1)
+}
+
+//ConnectionClosed counts a websocket as closed and adds its lifetime to the total
+func (em *ExpvarMetrics) ConnectionClosed(lifetime time.Duration) {
+	em.connectionsClosed.Add(1)
+	em.activeConnections.Add(-1)
+	em.connectionSeconds.Add(lifetime.Seconds())
+}
+
+//AcceptQueueDepth records the number of connections waiting for Accept
+func (em *ExpvarMetrics) AcceptQueueDepth(depth int) { em.acceptQueueDepth.Set(int64(depth)) }
+
+//BytesReceived counts message payload bytes received
+func (em *ExpvarMetrics) BytesReceived(n int) { em.bytesReceived.Add(int64(n)) }
+
+//BytesSent counts message payload bytes sent
+func (em *ExpvarMetrics) BytesSent(n int) { em.bytesSent.Add(int64(n)) }
+
+//connectionBuckets are the upper bounds in seconds of the connection lifetime
+// histogram buckets reported by PrometheusMetrics
+var connectionBuckets = []float64{1, 10, 60, 300, 1800, 3600, 6 * 3600, 24 * 3600}
+
+//PrometheusMetrics is a MetricsCollector that serves its metrics in the
+// Prometheus text exposition format, it is an http.Handler to be mounted where
+// Prometheus scrapes (ex. "/metrics") and has no dependencies on Prometheus
+// client libraries.
+type PrometheusMetrics struct {
+	//64-bit values accessed atomically come first to guarantee their alignment
+	upgradeAttempts, activeConnections, acceptQueueDepth int64
+	bytesReceived, bytesSent                             int64
+
+	namespace string
+
+	lock            sync.Mutex
+	upgradeFailures map[string]int64
+	lifetimeCounts  []int64 //Per bucket of connectionBuckets, not cumulative, +Inf last
+	lifetimeSum     float64
+	lifetimeCount   int64
+}
+
+var (
+	_ MetricsCollector = (*PrometheusMetrics)(nil)
+	_ http.Handler     = (*PrometheusMetrics)(nil)
+)
+
+//NewPrometheusMetrics returns a PrometheusMetrics whose metric names start with
+// the provided namespace, if empty "wasmws" is used.
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	if namespace == "" {
+		namespace = "wasmws"
+	}
+	return &PrometheusMetrics{
+		namespace:       namespace,
+		upgradeFailures: make(map[string]int64),
+		lifetimeCounts:  make([]int64, len(connectionBuckets)+1),
+	}
+}
+
+//UpgradeAttempted counts an HTTP request received
+func (pm *PrometheusMetrics) UpgradeAttempted() { atomic.AddInt64(&pm.upgradeAttempts, 1) }
+
+//UpgradeFailed counts a request that was not accepted by reason
+func (pm *PrometheusMetrics) UpgradeFailed(reason string) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.upgradeFailures[reason]++
+}
+
+//ConnectionOpened counts an upgraded websocket as active
+func (pm *PrometheusMetrics) ConnectionOpened() { atomic.AddInt64(&pm.activeConnections, 1) }
+
+//ConnectionClosed counts a websocket as no longer active and records its
+// lifetime in the histogram
+func (pm *PrometheusMetrics) ConnectionClosed(lifetime time.Duration) {
+	atomic.AddInt64(&pm.activeConnections, -1)
+
+	seconds := lifetime.Seconds()
+	bucket := sort.SearchFloat64s(connectionBuckets, seconds)
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.lifetimeCounts[bucket]++
+	pm.lifetimeSum += seconds
+	pm.lifetimeCount++
+}
+
+//AcceptQueueDepth records the number of connections waiting for Accept
+func (pm *PrometheusMetrics) AcceptQueueDepth(depth int) {
+	atomic.StoreInt64(&pm.acceptQueueDepth, int64(depth))
+}
+
+//BytesReceived counts message payload bytes received
+func (pm *PrometheusMetrics) BytesReceived(n int) { atomic.AddInt64(&pm.bytesReceived, int64(n)) }
+
+//BytesSent counts message payload bytes sent
+func (pm *PrometheusMetrics) BytesSent(n int) { atomic.AddInt64(&pm.bytesSent, int64(n)) }
+
+//ServeHTTP serves the metrics in the Prometheus text exposition format
+func (pm *PrometheusMetrics) ServeHTTP(wtr http.ResponseWriter, req *http.Request) {
+	wtr.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	pm.WriteTo(wtr)
+}
+
+//WriteTo writes the metrics in the Prometheus text exposition format
+func (pm *PrometheusMetrics) WriteTo(wtr io.Writer) (int64, error) {
+	out := &countWriter{wtr: wtr}
+	ns := pm.namespace
+
+	writeMetric(out, ns+"_upgrade_attempts_total", "counter", "HTTP requests received by the websocket listener.")
+	fmt.Fprintf(out, "%s_upgrade_attempts_total %d\n", ns, atomic.LoadInt64(&pm.upgradeAttempts))
+
+	pm.lock.Lock()
+	reasons := make([]string, 0, len(pm.upgradeFailures))
+	for reason := range pm.upgradeFailures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	writeMetric(out, ns+"_upgrade_failures_total", "counter", "HTTP requests that did not result in an accepted websocket by reason.")
+	for _, reason := range reasons {
+		fmt.Fprintf(out, "%s_upgrade_failures_total{reason=%q} %d\n", ns, reason, pm.upgradeFailures[reason])
+	}
+
+	writeMetric(out, ns+"_connection_duration_seconds", "histogram", "Lifetimes of closed websocket connections.")
+	var cumulative int64
+	for i, bound := range connectionBuckets {
+		cumulative += pm.lifetimeCounts[i]
+		fmt.Fprintf(out, "%s_connection_duration_seconds_bucket{le=\"%g\"} %d\n", ns, bound, cumulative)
+	}
+	fmt.Fprintf(out, "%s_connection_duration_seconds_bucket{le=\"+Inf\"} %d\n", ns, pm.lifetimeCount)
+	fmt.Fprintf(out, "%s_connection_duration_seconds_sum %g\n", ns, pm.lifetimeSum)
+	fmt.Fprintf(out, "%s_connection_duration_seconds_count %d\n", ns, pm.lifetimeCount)
+	pm.lock.Unlock()
+
+	writeMetric(out, ns+"_active_connections", "gauge", "Websocket connections that are open.")
+	fmt.Fprintf(out, "%s_active_connections %d\n", ns, atomic.LoadInt64(&pm.activeConnections))
+	writeMetric(out, ns+"_accept_queue_depth", "gauge", "Websocket connections waiting to be accepted.")
+	fmt.Fprintf(out, "%s_accept_queue_depth %d\n", ns, atomic.LoadInt64(&pm.acceptQueueDepth))
+	writeMetric(out, ns+"_received_bytes_total", "counter", "Websocket message payload bytes received.")
+	fmt.Fprintf(out, "%s_received_bytes_total %d\n", ns, atomic.LoadInt64(&pm.bytesReceived))
+	writeMetric(out, ns+"_sent_bytes_total", "counter", "Websocket message payload bytes sent.")
+	fmt.Fprintf(out, "%s_sent_bytes_total %d\n", ns, atomic.LoadInt64(&pm.bytesSent))
+	return out.n, out.err
+}
+
+//writeMetric writes the HELP and TYPE lines of a metric
+func writeMetric(wtr io.Writer, name, typ, help string) {
+	fmt.Fprintf(wtr, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+//countWriter counts the bytes written and retains the first error, after which
+// writes are discarded
+type countWriter struct {
+	wtr io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(buf []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.wtr.Write(buf)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,144 @@
+// +build !js,!wasm
+
+package wasmws
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//exerciseMetrics performs an unauthorized upgrade and then echos a message of the
+// provided size over an accepted connection that is then closed
+func exerciseMetrics(t *testing.T, metrics MetricsCollector, msgSize int) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsl, wsURL := newTestListener(t, ListenerOptions{
+		Metrics: metrics,
+		Logger:  nopLogger{},
+		Authenticate: func(req *http.Request) (interface{}, error) {
+			if req.URL.Query().Get("deny") != "" {
+				return nil, NewAuthError(http.StatusForbidden, "denied")
+			}
+			return nil, nil
+		},
+	})
+	if _, err := DialContext(testCtx, "websocket", wsURL+"?deny=1"); err == nil {
+		t.Fatalf("Dial should have been rejected")
+	}
+
+	conn, err := DialContext(testCtx, "websocket", wsURL)
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	serverConn, err := wsl.Accept()
+	if err != nil {
+		t.Fatalf("Could not accept test connection; Details: %s", err)
+	}
+	go func() {
+		io.Copy(serverConn, serverConn)
+		serverConn.Close()
+	}()
+
+	msg := make([]byte, msgSize)
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatalf("Could not write to test connection; Details: %s", err)
+	}
+	if _, err = io.ReadFull(conn, msg); err != nil {
+		t.Fatalf("Could not read from test connection; Details: %s", err)
+	}
+	conn.Close()
+
+	//Wait for the server to observe the close
+	for wsl.Stats().Active > 0 {
+		select {
+		case <-testCtx.Done():
+			t.Fatalf("Listener did not observe the connection close")
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	const msgSize = 1000
+	metrics := NewPrometheusMetrics("test")
+	exerciseMetrics(t, metrics, msgSize)
+
+	//Scrape
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Could not scrape metrics; Details: %s", err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Fatalf("Metrics were served as %q rather than the Prometheus text format", contentType)
+	}
+
+	samples := make(map[string]float64)
+	for scanner := bufio.NewScanner(resp.Body); scanner.Scan(); {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[sep+1:], 64)
+		if err != nil {
+			t.Fatalf("Metrics line %q has an invalid value; Details: %s", line, err)
+		}
+		samples[line[:sep]] = value
+	}
+
+	for name, expected := range map[string]float64{
+		`test_upgrade_attempts_total`:                        2,
+		`test_upgrade_failures_total{reason="unauthorized"}`: 1,
+		`test_active_connections`:                            0,
+		`test_accept_queue_depth`:                            0,
+		`test_received_bytes_total`:                          msgSize,
+		`test_sent_bytes_total`:                              msgSize,
+		`test_connection_duration_seconds_bucket{le="1"}`:    1,
+		`test_connection_duration_seconds_bucket{le="+Inf"}`: 1,
+		`test_connection_duration_seconds_count`:             1,
+	} {
+		if value, found := samples[name]; !found || value != expected {
+			t.Fatalf("Metric %s was %g (found: %t) rather than %g", name, value, found, expected)
+		}
+	}
+}
+
+var expvarTestRuns int64
+
+func TestExpvarMetrics(t *testing.T) {
+	const msgSize = 1000
+	//expvar names can only be published once per process
+	name := "wasmws_test_" + strconv.FormatInt(atomic.AddInt64(&expvarTestRuns, 1), 10)
+	exerciseMetrics(t, NewExpvarMetrics(name), msgSize)
+
+	var vars struct {
+		UpgradeAttempts   int64            `json:"upgrade_attempts"`
+		UpgradeFailures   map[string]int64 `json:"upgrade_failures"`
+		ConnectionsClosed int64            `json:"connections_closed"`
+		ActiveConnections int64            `json:"active_connections"`
+		BytesReceived     int64            `json:"bytes_received"`
+		BytesSent         int64            `json:"bytes_sent"`
+	}
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &vars); err != nil {
+		t.Fatalf("Could not decode published expvar; Details: %s", err)
+	}
+	if vars.UpgradeAttempts != 2 || vars.UpgradeFailures[FailureUnauthorized] != 1 || vars.ConnectionsClosed != 1 ||
+		vars.ActiveConnections != 0 || vars.BytesReceived != msgSize || vars.BytesSent != msgSize {
+		t.Fatalf("Published expvar had unexpected values: %+v", vars)
+	}
+}
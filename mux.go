@@ -0,0 +1,599 @@
+package wasmws
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+//Multiplexed sessions carry any number of independent bidirectional streams over
+// a single connection (ex. a websocket), so a browser application limited in the
+// number of websockets it may open can still run several protocols (gRPC, HTTP,
+// logs...) concurrently. Streams are opened with a name the accepting side uses
+// to route them; See: MuxListener. Each stream has a receive window its peer may
+// not exceed, so a stream that is not being read does not stall the others.
+// Clients number their streams with odd IDs and servers with even ones.
+//
+// Frame format: type (1 byte) | stream ID (4 bytes) | value (4 bytes) | payload
+//  open:   a new stream, value is the payload length and the payload is its name
+//  data:   value is the payload length
+//  window: value is the number of bytes consumed since the last window frame
+//  close:  the sender will not write to the stream anymore (half-close)
+//  reset:  the stream was aborted (ex. its name is unknown or it was closed unread)
+
+var (
+	//ErrMuxSessionClosed is returned when operations are performed on a closed
+	// multiplexed session or its streams, errors.Is(err, net.ErrClosed) is true.
+	ErrMuxSessionClosed = fmt.Errorf("WebSocket: Multiplexed session is closed; Details: %w", net.ErrClosed)
+
+	//ErrStreamClosed is returned when operations are performed on a closed stream
+	ErrStreamClosed = errors.New("WebSocket: Multiplexed stream is closed")
+
+	//ErrStreamReset is returned when a stream was aborted by its peer, ex. when
+	// the peer closed it without reading everything that was sent
+	ErrStreamReset = errors.New("WebSocket: Multiplexed stream was reset by its peer")
+)
+
+//MuxOptions configures multiplexed sessions; See: NewMuxClient, NewMuxServer and
+// NewMuxListener. The zero value uses the defaults.
+type MuxOptions struct {
+	//AcceptBacklog is the number of streams opened by the peer that may wait for
+	// AcceptStream, further streams are reset. Defaults to 64.
+	AcceptBacklog int
+}
+
+const (
+	defaultMuxAcceptBacklog = 64
+
+	muxFrameHeaderSize = 9
+	muxMaxPayload      = 32 * 1024
+	muxWindowSize      = 256 * 1024 //Bytes a stream may receive before they are read
+	muxMaxNameSize     = 1024
+)
+
+const (
+	muxFrameOpen byte = iota + 1
+	muxFrameData
+	muxFrameWindow
+	muxFrameClose
+	muxFrameReset
+)
+
+//MuxSession is one end of a multiplexed session; See the top of this file for an
+// overview. It implements net.Listener, accepting the streams opened by the peer.
+type MuxSession struct {
+	conn      net.Conn
+	client    bool
+	writeLock sync.Mutex //Serializes frame writes to conn
+
+	lock     sync.Mutex
+	streams  map[uint32]*MuxStream
+	nextID   uint32
+	err      error //Set once the session has ended
+	done     chan struct{}
+	acceptCh chan *MuxStream
+}
+
+var _ net.Listener = (*MuxSession)(nil)
+
+//NewMuxClient starts the client end of a multiplexed session over the provided
+// connection, ex. a websocket returned by DialContext. The options may be nil to
+// use the defaults.
+func NewMuxClient(conn net.Conn, opts *MuxOptions) *MuxSession {
+	return newMuxSession(conn, true, opts)
+}
+
+//NewMuxServer starts the server end of a multiplexed session over the provided
+// connection, ex. one accepted by a WebSockListener. The options may be nil to
+// use the defaults; See: NewMuxListener to serve the sessions of a listener.
+func NewMuxServer(conn net.Conn, opts *MuxOptions) *MuxSession {
+	return newMuxSession(conn, false, opts)
+}
+
+//newMuxSession starts a session over the provided connection
+func newMuxSession(conn net.Conn, client bool, opts *MuxOptions) *MuxSession {
+	backlog := defaultMuxAcceptBacklog
+	if opts != nil && opts.AcceptBacklog > 0 {
+		backlog = opts.AcceptBacklog
+	}
+
+	ms := &MuxSession{
+		conn:     conn,
+		client:   client,
+		streams:  make(map[uint32]*MuxStream),
+		nextID:   2,
+		done:     make(chan struct{}),
+		acceptCh: make(chan *MuxStream, backlog),
+	}
+	if client {
+		ms.nextID = 1
+	}
+	go ms.readLoop()
+	return ms
+}
+
+//OpenStream opens a new stream with the provided name, which the peer can use to
+// route it. The returned connection is a *MuxStream.
+func (ms *MuxSession) OpenStream(name string) (net.Conn, error) {
+	if len(name) > muxMaxNameSize {
+		return nil, fmt.Errorf("WebSocket: Stream name is %d bytes; Details: At most %d bytes are allowed", len(name), muxMaxNameSize)
+	}
+
+	ms.lock.Lock()
+	if ms.err != nil {
+		ms.lock.Unlock()
+		return nil, ms.err
+	}
+	stream := newMuxStream(ms, ms.nextID, name)
+	ms.streams[stream.id] = stream
+	ms.nextID += 2
+	ms.lock.Unlock()
+
+	if err := ms.writeFrame(muxFrameOpen, stream.id, uint32(len(name)), []byte(name)); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+//DialContext opens a new stream named by the address and is compatible with
+// grpc.WithContextDialer. It takes no network, so uses such as
+// http.Transport.DialContext need a wrapping function that discards it.
+func (ms *MuxSession) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	return ms.OpenStream(address)
+}
+
+//AcceptStream waits for and returns the next stream opened by the peer, the
+// returned connection is a *MuxStream.
+func (ms *MuxSession) AcceptStream() (net.Conn, error) {
+	select {
+	case stream := <-ms.acceptCh:
+		return stream, nil
+	case <-ms.done:
+		return nil, ms.err
+	}
+}
+
+//Accept fulfills the net.Listener interface by calling AcceptStream
+func (ms *MuxSession) Accept() (net.Conn, error) {
+	return ms.AcceptStream()
+}
+
+//Addr returns the local address of the underlying connection
+func (ms *MuxSession) Addr() net.Addr {
+	return ms.conn.LocalAddr()
+}
+
+//Close closes the session, all of its streams and the underlying connection
+func (ms *MuxSession) Close() error {
+	ms.closeWithErr(ErrMuxSessionClosed)
+	return nil
+}
+
+//NumStreams returns the number of open streams
+func (ms *MuxSession) NumStreams() int {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return len(ms.streams)
+}
+
+//closeWithErr ends the session, failing its streams with the provided error
+func (ms *MuxSession) closeWithErr(err error) {
+	ms.lock.Lock()
+	if ms.err != nil {
+		ms.lock.Unlock()
+		return
+	}
+	ms.err = err
+	close(ms.done)
+	streams := ms.streams
+	ms.streams = make(map[uint32]*MuxStream)
+	ms.lock.Unlock()
+
+	for _, stream := range streams {
+		stream.fail(err)
+	}
+	ms.conn.Close()
+}
+
+//removeStream forgets a stream that has ended
+func (ms *MuxSession) removeStream(id uint32) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.streams, id)
+}
+
+//stream returns the open stream with the provided ID, or nil
+func (ms *MuxSession) stream(id uint32) *MuxStream {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.streams[id]
+}
+
+//readLoop processes frames from the underlying connection until it fails
+func (ms *MuxSession) readLoop() {
+	for {
+		typ, id, value, payload, err := readMuxFrame(ms.conn)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				err = ErrMuxSessionClosed
+			} else {
+				err = fmt.Errorf("WebSocket: Multiplexed session failed; Details: %w", err)
+			}
+			ms.closeWithErr(err)
+			return
+		}
+
+		switch typ {
+		case muxFrameOpen:
+			if id == 0 || (id%2 == 1) == ms.client || ms.stream(id) != nil {
+				ms.closeWithErr(fmt.Errorf("WebSocket: Multiplexed session peer opened invalid stream %d", id))
+				return
+			}
+			stream := newMuxStream(ms, id, string(payload))
+			ms.lock.Lock()
+			ended := ms.err != nil
+			if !ended {
+				ms.streams[id] = stream
+			}
+			ms.lock.Unlock()
+			if ended { //The session was closed while the frame was read
+				return
+			}
+			select {
+			case ms.acceptCh <- stream:
+			default: //The backlog is full
+				go stream.abort()
+			}
+
+		case muxFrameData:
+			if stream := ms.stream(id); stream != nil {
+				if err := stream.receive(payload); err != nil {
+					ms.closeWithErr(err)
+					return
+				}
+			}
+
+		case muxFrameWindow:
+			if stream := ms.stream(id); stream != nil {
+				stream.grow(int(value))
+			}
+
+		case muxFrameClose:
+			if stream := ms.stream(id); stream != nil {
+				stream.remoteClose()
+			}
+
+		case muxFrameReset:
+			if stream := ms.stream(id); stream != nil {
+				stream.fail(ErrStreamReset)
+				ms.removeStream(id)
+			}
+
+		default:
+			ms.closeWithErr(fmt.Errorf("WebSocket: Multiplexed session received unexpected frame type %d", typ))
+			return
+		}
+	}
+}
+
+//writeFrame writes a single frame to the underlying connection, failing the
+// session if this is not possible
+func (ms *MuxSession) writeFrame(typ byte, id, value uint32, payload []byte) error {
+	frame := make([]byte, muxFrameHeaderSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint32(frame[5:], value)
+	copy(frame[muxFrameHeaderSize:], payload)
+
+	ms.writeLock.Lock()
+	defer ms.writeLock.Unlock()
+
+	select {
+	case <-ms.done:
+		return ms.err
+	default:
+	}
+	if _, err := ms.conn.Write(frame); err != nil {
+		err = fmt.Errorf("WebSocket: Multiplexed session failed; Details: %w", err)
+		go ms.closeWithErr(err) //Streams may be waiting on writeLock
+		return err
+	}
+	return nil
+}
+
+//readMuxFrame reads a single frame, the value is the payload size of frames with
+// a payload
+func readMuxFrame(rdr io.Reader) (typ byte, id, value uint32, payload []byte, err error) {
+	var header [muxFrameHeaderSize]byte
+	if _, err = io.ReadFull(rdr, header[:]); err != nil {
+		return 0, 0, 0, nil, err
+	}
+
+	typ, id, value = header[0], binary.BigEndian.Uint32(header[1:]), binary.BigEndian.Uint32(header[5:])
+	if typ == muxFrameOpen || typ == muxFrameData {
+		if value > muxMaxPayload {
+			return 0, 0, 0, nil, fmt.Errorf("WebSocket: Multiplexed session frame of %d bytes exceeds maximum of %d", value, muxMaxPayload)
+		}
+		payload = make([]byte, value)
+		if _, err = io.ReadFull(rdr, payload); err != nil {
+			return 0, 0, 0, nil, err
+		}
+	}
+	return typ, id, value, payload, nil
+}
+
+//MuxStream is a stream of a multiplexed session, it implements net.Conn
+type MuxStream struct {
+	session   *MuxSession
+	id        uint32
+	name      string
+	writeLock sync.Mutex //Serializes Write calls
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	recvBuf       bytes.Buffer //Bytes received but not yet read
+	recvConsumed  int          //Bytes read since the last window frame
+	sendWindow    int          //Bytes that may be sent before the peer grows the window
+	localClosed   bool         //Close was called
+	writeClosed   bool         //A close frame was sent
+	remoteClosed  bool         //A close frame was received
+	err           error
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+var _ net.Conn = (*MuxStream)(nil)
+
+//newMuxStream returns an open stream of the provided session
+func newMuxStream(session *MuxSession, id uint32, name string) *MuxStream {
+	stream := &MuxStream{
+		session:    session,
+		id:         id,
+		name:       name,
+		sendWindow: muxWindowSize,
+	}
+	stream.cond = sync.NewCond(&stream.mu)
+	return stream
+}
+
+//Name returns the name the stream was opened with
+func (stream *MuxStream) Name() string {
+	return stream.name
+}
+
+//Read implements the standard io.Reader interface (typical semantics)
+func (stream *MuxStream) Read(buf []byte) (int, error) {
+	if len(buf) < 1 {
+		return 0, nil
+	}
+
+	stream.mu.Lock()
+	for stream.recvBuf.Len() < 1 {
+		var err error
+		switch {
+		case stream.localClosed:
+			err = ErrStreamClosed
+		case stream.remoteClosed:
+			err = io.EOF
+		case stream.err != nil:
+			err = stream.err
+		case stream.readDeadline.expired:
+			err = timeoutError{}
+		}
+		if err != nil {
+			stream.mu.Unlock()
+			return 0, err
+		}
+		stream.cond.Wait()
+	}
+
+	n, _ := stream.recvBuf.Read(buf)
+	stream.recvConsumed += n
+	var grow int
+	if stream.recvConsumed >= muxWindowSize/2 && stream.err == nil { //Coalesce window frames
+		grow, stream.recvConsumed = stream.recvConsumed, 0
+	}
+	stream.mu.Unlock()
+
+	if grow > 0 {
+		stream.session.writeFrame(muxFrameWindow, stream.id, uint32(grow), nil)
+	}
+	return n, nil
+}
+
+//Write implements the standard io.Writer interface, writes block while the
+// peer's receive window is full
+func (stream *MuxStream) Write(buf []byte) (n int, err error) {
+	stream.writeLock.Lock()
+	defer stream.writeLock.Unlock()
+
+	for len(buf) > 0 {
+		stream.mu.Lock()
+		for {
+			switch {
+			case stream.localClosed || stream.writeClosed:
+				err = ErrStreamClosed
+			case stream.err != nil:
+				err = stream.err
+			case stream.writeDeadline.expired:
+				err = timeoutError{}
+			}
+			if err != nil {
+				stream.mu.Unlock()
+				return n, err
+			}
+			if stream.sendWindow > 0 {
+				break
+			}
+			stream.cond.Wait()
+		}
+
+		size := stream.sendWindow
+		if size > len(buf) {
+			size = len(buf)
+		}
+		if size > muxMaxPayload {
+			size = muxMaxPayload
+		}
+		stream.sendWindow -= size
+		stream.mu.Unlock()
+
+		if err = stream.session.writeFrame(muxFrameData, stream.id, uint32(size), buf[:size]); err != nil {
+			return n, err
+		}
+		buf, n = buf[size:], n+size
+	}
+	return n, nil
+}
+
+//CloseWrite closes the sending side of the stream, the peer's reads return
+// io.EOF once they have consumed everything that was sent while the stream can
+// still be read.
+func (stream *MuxStream) CloseWrite() error {
+	stream.writeLock.Lock()
+	defer stream.writeLock.Unlock()
+
+	stream.mu.Lock()
+	if stream.writeClosed || stream.err != nil {
+		stream.mu.Unlock()
+		return nil
+	}
+	stream.writeClosed = true
+	ended := stream.remoteClosed
+	stream.mu.Unlock()
+
+	err := stream.session.writeFrame(muxFrameClose, stream.id, 0, nil)
+	if ended {
+		stream.session.removeStream(stream.id)
+	}
+	return err
+}
+
+//Close closes the stream, the peer's reads return io.EOF once they have consumed
+// everything that was sent. If data sent by the peer was left unread, the stream
+// is reset instead so the peer's writes fail rather than block.
+func (stream *MuxStream) Close() error {
+	stream.mu.Lock()
+	if stream.localClosed {
+		stream.mu.Unlock()
+		return nil
+	}
+	stream.localClosed = true
+	unread := stream.recvBuf.Len() > 0 && !stream.remoteClosed
+	stream.cond.Broadcast() //Wake blocked reads and writes
+	stream.mu.Unlock()
+
+	if unread {
+		stream.abort()
+		return nil
+	}
+	return stream.CloseWrite()
+}
+
+//abort resets the stream, failing it locally and for the peer
+func (stream *MuxStream) abort() {
+	stream.fail(ErrStreamClosed)
+	stream.session.removeStream(stream.id)
+	stream.session.writeFrame(muxFrameReset, stream.id, 0, nil)
+}
+
+//receive buffers data sent by the peer, data for a closed stream is discarded
+// and the stream reset. An error is returned if the peer exceeded the window.
+func (stream *MuxStream) receive(data []byte) error {
+	stream.mu.Lock()
+	if stream.localClosed {
+		stream.mu.Unlock()
+		go stream.abort() //Don't block the session's readLoop
+		return nil
+	}
+	if stream.recvBuf.Len()+stream.recvConsumed+len(data) > muxWindowSize {
+		stream.mu.Unlock()
+		return fmt.Errorf("WebSocket: Multiplexed session peer exceeded the receive window of stream %d", stream.id)
+	}
+	stream.recvBuf.Write(data)
+	stream.cond.Broadcast()
+	stream.mu.Unlock()
+	return nil
+}
+
+//grow increases the send window after the peer consumed data
+func (stream *MuxStream) grow(size int) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	stream.sendWindow += size
+	stream.cond.Broadcast()
+}
+
+//remoteClose records that the peer will not write anymore
+func (stream *MuxStream) remoteClose() {
+	stream.mu.Lock()
+	stream.remoteClosed = true
+	ended := stream.writeClosed
+	stream.cond.Broadcast()
+	stream.mu.Unlock()
+
+	if ended {
+		stream.session.removeStream(stream.id)
+	}
+}
+
+//fail ends the stream with the provided error unless it already failed
+func (stream *MuxStream) fail(err error) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if stream.err == nil {
+		stream.err = err
+	}
+	stream.cond.Broadcast()
+}
+
+//NetConn returns the session's underlying connection
+func (stream *MuxStream) NetConn() net.Conn {
+	return stream.session.conn
+}
+
+//LocalAddr returns the local address of the session's connection
+func (stream *MuxStream) LocalAddr() net.Addr {
+	return stream.session.conn.LocalAddr()
+}
+
+//RemoteAddr returns the remote address of the session's connection
+func (stream *MuxStream) RemoteAddr() net.Addr {
+	return stream.session.conn.RemoteAddr()
+}
+
+//SetDeadline implements the Conn SetDeadline method
+func (stream *MuxStream) SetDeadline(future time.Time) error {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	stream.readDeadline.set(future, stream.cond)
+	stream.writeDeadline.set(future, stream.cond)
+	return nil
+}
+
+//SetReadDeadline implements the Conn SetReadDeadline method
+func (stream *MuxStream) SetReadDeadline(future time.Time) error {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	stream.readDeadline.set(future, stream.cond)
+	return nil
+}
+
+//SetWriteDeadline implements the Conn SetWriteDeadline method
+func (stream *MuxStream) SetWriteDeadline(future time.Time) error {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	stream.writeDeadline.set(future, stream.cond)
+	return nil
+}
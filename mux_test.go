@@ -0,0 +1,290 @@
+// +build !js,!wasm
+
+package wasmws
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	pb "google.golang.org/grpc/examples/helloworld/helloworld"
+)
+
+//newTestMux returns the client and server ends of a multiplexed session over an
+// in-memory connection
+func newTestMux(t *testing.T) (*MuxSession, *MuxSession) {
+	clientConn, serverConn := net.Pipe()
+	client, server := NewMuxClient(clientConn, nil), NewMuxServer(serverConn, nil)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+//muxEcho echos each accepted stream prefixed by its name until the session ends
+func muxEcho(session *MuxSession) {
+	for {
+		conn, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.WriteString(conn, conn.(*MuxStream).Name()+":")
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+func TestMuxStreams(t *testing.T) {
+	client, server := newTestMux(t)
+	go muxEcho(server)
+
+	//Transfer more than the receive window on several concurrent streams
+	const streamCount, msgSize = 8, muxWindowSize * 4
+	var wg sync.WaitGroup
+	errCh := make(chan error, streamCount)
+	for i := 0; i < streamCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("stream%d", i)
+			conn, err := client.OpenStream(name)
+			if err != nil {
+				errCh <- fmt.Errorf("Could not open stream %q; Details: %w", name, err)
+				return
+			}
+			defer conn.Close()
+
+			msg := bytes.Repeat([]byte{byte(i)}, msgSize)
+			go func() {
+				conn.Write(msg)
+				conn.(*MuxStream).CloseWrite()
+			}()
+			reply, err := ioutil.ReadAll(conn)
+			if err != nil {
+				errCh <- fmt.Errorf("Could not read stream %q; Details: %w", name, err)
+				return
+			}
+			if expected := append([]byte(name+":"), msg...); !bytes.Equal(reply, expected) {
+				errCh <- fmt.Errorf("Stream %q echoed %d bytes that differ from the %d sent", name, len(reply), len(expected))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	//Streams are forgotten once both sides have closed them
+	for deadline := time.Now().Add(time.Second * 5); client.NumStreams() > 0 || server.NumStreams() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Session retained %d client and %d server streams", client.NumStreams(), server.NumStreams())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	client, server := newTestMux(t)
+
+	//A stream that is not being read must not block the session's other streams
+	stalled, err := client.OpenStream("stalled")
+	if err != nil {
+		t.Fatalf("Could not open stream; Details: %s", err)
+	}
+	stalledServer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("Could not accept stream; Details: %s", err)
+	}
+	stalled.SetWriteDeadline(time.Now().Add(time.Millisecond * 200))
+	n, err := stalled.Write(make([]byte, muxWindowSize*2))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() || n != muxWindowSize {
+		t.Fatalf("Write exceeding the window should have timed out after %d bytes, not %d; Details: %v", muxWindowSize, n, err)
+	}
+
+	go muxEcho(server)
+	conn, err := client.OpenStream("live")
+	if err != nil {
+		t.Fatalf("Could not open stream; Details: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	reply := make([]byte, len("live:hello"))
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err = io.ReadFull(conn, reply); err != nil || string(reply) != "live:hello" {
+		t.Fatalf("Stream echoed %q rather than %q; Details: %v", reply, "live:hello", err)
+	}
+
+	//Closing a stream with unread data resets it for the peer
+	stalledServer.Close()
+	stalled.SetWriteDeadline(time.Time{})
+	for deadline := time.Now().Add(time.Second * 5); ; {
+		if _, err = stalled.Write([]byte("more")); errors.Is(err, ErrStreamReset) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Write to a reset stream should have failed with ErrStreamReset, not: %v", err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestMuxClose(t *testing.T) {
+	client, server := newTestMux(t)
+	conn, err := client.OpenStream("test")
+	if err != nil {
+		t.Fatalf("Could not open stream; Details: %s", err)
+	}
+	if _, err = server.AcceptStream(); err != nil {
+		t.Fatalf("Could not accept stream; Details: %s", err)
+	}
+
+	client.Close()
+	if _, err = conn.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Read of a stream of a closed session should fail with net.ErrClosed, not: %v", err)
+	}
+	if _, err = server.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept after the peer closed the session should fail with net.ErrClosed, not: %v", err)
+	}
+	if _, err = client.OpenStream("test"); !errors.Is(err, ErrMuxSessionClosed) {
+		t.Fatalf("OpenStream of a closed session should fail with ErrMuxSessionClosed, not: %v", err)
+	}
+}
+
+//keepReadingConn is a connection that can still be read after it is closed
+type keepReadingConn struct{ net.Conn }
+
+func (keepReadingConn) Close() error { return nil }
+
+func TestMuxInvalidStreams(t *testing.T) {
+	openFrame := func(id uint32) []byte {
+		frame := make([]byte, muxFrameHeaderSize+len("test"))
+		frame[0] = muxFrameOpen
+		binary.BigEndian.PutUint32(frame[1:], id)
+		binary.BigEndian.PutUint32(frame[5:], uint32(len("test")))
+		copy(frame[muxFrameHeaderSize:], "test")
+		return frame
+	}
+
+	//Clients refuse stream 0 and odd IDs
+	for _, id := range []uint32{0, 1} {
+		clientConn, peerConn := net.Pipe()
+		client := NewMuxClient(clientConn, nil)
+		defer client.Close()
+		go peerConn.Write(openFrame(id))
+		if _, err := client.AcceptStream(); err == nil || !strings.Contains(err.Error(), "invalid stream") {
+			t.Fatalf("Stream %d opened by a server should have failed the session as invalid, not: %v", id, err)
+		}
+	}
+
+	//Streams opened after the session ended are not accepted
+	clientConn, peerConn := net.Pipe()
+	client := NewMuxClient(keepReadingConn{clientConn}, nil)
+	client.Close()
+	if _, err := peerConn.Write(openFrame(2)); err != nil {
+		t.Fatalf("Could not write open frame; Details: %s", err)
+	}
+	peerConn.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
+	peerConn.Write(openFrame(4)) //Once read the first frame was handled
+	if queued := len(client.acceptCh); queued > 0 {
+		t.Fatalf("Session that ended queued %d streams opened afterwards", queued)
+	}
+}
+
+func TestMuxListener(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsl, wsURL := newTestListener(t, ListenerOptions{})
+	ml := NewMuxListener(wsl, nil)
+	defer ml.Close()
+
+	grpcListener, err := ml.Listen("grpc")
+	if err != nil {
+		t.Fatalf("Could not listen for gRPC streams; Details: %s", err)
+	}
+	grpcServer := grpc.NewServer(grpc.Creds(GRPCServerCredentials(nil)))
+	pb.RegisterGreeterServer(grpcServer, testGreeter{})
+	go grpcServer.Serve(grpcListener)
+	defer grpcServer.Stop()
+
+	echoListener, err := ml.Listen("echo")
+	if err != nil {
+		t.Fatalf("Could not listen for echo streams; Details: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	//gRPC and the echo stream share a single websocket
+	ws, err := DialContext(testCtx, "websocket", wsURL)
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	session := NewMuxClient(ws, nil)
+	defer session.Close()
+
+	grpcConn, err := grpc.DialContext(testCtx, "passthrough:///grpc", grpc.WithContextDialer(session.DialContext), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatalf("Could not gRPC dial over multiplexed session; Details: %s", err)
+	}
+	defer grpcConn.Close()
+	reply, err := pb.NewGreeterClient(grpcConn).SayHello(testCtx, &pb.HelloRequest{Name: "test"})
+	if err != nil {
+		t.Fatalf("gRPC call failed; Details: %s", err)
+	}
+	if expected := "Go-http-client/1.1 " + (&net.TCPAddr{}).Network(); reply.GetMessage() != expected {
+		t.Fatalf("gRPC reply was %q rather than %q", reply.GetMessage(), expected)
+	}
+
+	echo, err := session.OpenStream("echo")
+	if err != nil {
+		t.Fatalf("Could not open echo stream; Details: %s", err)
+	}
+	defer echo.Close()
+	echo.Write([]byte("hello"))
+	buf := make([]byte, len("hello"))
+	if _, err = io.ReadFull(echo, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("Echo stream returned %q; Details: %v", buf, err)
+	}
+
+	//Streams with unknown names are reset
+	unknown, err := session.OpenStream("unknown")
+	if err != nil {
+		t.Fatalf("Could not open stream; Details: %s", err)
+	}
+	if _, err = unknown.Read(buf); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("Read of a stream with an unknown name should fail with ErrStreamReset, not: %v", err)
+	}
+
+	if _, err = ml.Listen("echo"); err == nil {
+		t.Fatalf("Listening for the same name twice should fail")
+	}
+	ml.Close()
+	if _, err = echoListener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept of a closed MuxListener should fail with net.ErrClosed, not: %v", err)
+	}
+}
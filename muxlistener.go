@@ -0,0 +1,192 @@
+package wasmws
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+//MuxListener serves multiplexed sessions over the connections accepted by a
+// listener (ex. a WebSockListener) and routes the streams opened by clients to
+// per name listeners; See: Listen. This allows several servers (ex. a gRPC server
+// and an HTTP server) to share each client's websocket.
+type MuxListener struct {
+	ln   net.Listener
+	opts *MuxOptions
+
+	lock     sync.Mutex
+	closed   bool
+	routes   map[string]*muxRoute
+	sessions map[*MuxSession]bool
+}
+
+//NewMuxListener starts serving multiplexed sessions over the connections accepted
+// by the provided listener, the options may be nil to use the defaults. Streams
+// with names not passed to Listen are reset.
+func NewMuxListener(ln net.Listener, opts *MuxOptions) *MuxListener {
+	ml := &MuxListener{
+		ln:       ln,
+		opts:     opts,
+		routes:   make(map[string]*muxRoute),
+		sessions: make(map[*MuxSession]bool),
+	}
+	go ml.acceptLoop()
+	return ml
+}
+
+//Listen returns a listener accepting the streams opened with the provided name,
+// closing it resets further streams with that name.
+func (ml *MuxListener) Listen(name string) (net.Listener, error) {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+
+	if ml.closed {
+		return nil, fmt.Errorf("MuxListener: Listener is closed; Details: %w", net.ErrClosed)
+	}
+	if _, found := ml.routes[name]; found {
+		return nil, fmt.Errorf("MuxListener: Streams named %q are already being listened for", name)
+	}
+
+	backlog := defaultMuxAcceptBacklog
+	if ml.opts != nil && ml.opts.AcceptBacklog > 0 {
+		backlog = ml.opts.AcceptBacklog
+	}
+	route := &muxRoute{
+		owner:    ml,
+		name:     name,
+		acceptCh: make(chan *MuxStream, backlog),
+		done:     make(chan struct{}),
+	}
+	ml.routes[name] = route
+	return route, nil
+}
+
+//Addr returns the address of the underlying listener
+func (ml *MuxListener) Addr() net.Addr {
+	return ml.ln.Addr()
+}
+
+//Close closes the underlying listener, the listeners returned by Listen and all
+// multiplexed sessions
+func (ml *MuxListener) Close() error {
+	ml.lock.Lock()
+	if ml.closed {
+		ml.lock.Unlock()
+		return nil
+	}
+	ml.closed = true
+	routes, sessions := ml.routes, ml.sessions
+	ml.routes, ml.sessions = make(map[string]*muxRoute), make(map[*MuxSession]bool)
+	ml.lock.Unlock()
+
+	err := ml.ln.Close()
+	for _, route := range routes {
+		route.closeOnce.Do(func() { close(route.done) })
+	}
+	for session := range sessions {
+		session.Close()
+	}
+	return err
+}
+
+//acceptLoop starts a session for each accepted connection until the underlying
+// listener fails
+func (ml *MuxListener) acceptLoop() {
+	defer ml.Close()
+	for {
+		conn, err := ml.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		session := NewMuxServer(conn, ml.opts)
+		ml.lock.Lock()
+		if ml.closed {
+			ml.lock.Unlock()
+			session.Close()
+			return
+		}
+		ml.sessions[session] = true
+		ml.lock.Unlock()
+
+		go ml.serveSession(session)
+	}
+}
+
+//serveSession routes the streams of the provided session until it ends
+func (ml *MuxListener) serveSession(session *MuxSession) {
+	defer func() {
+		ml.lock.Lock()
+		delete(ml.sessions, session)
+		ml.lock.Unlock()
+	}()
+
+	for {
+		conn, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		stream := conn.(*MuxStream)
+
+		ml.lock.Lock()
+		route := ml.routes[stream.Name()]
+		ml.lock.Unlock()
+		if route == nil {
+			stream.abort()
+			continue
+		}
+
+		select {
+		case <-route.done:
+			stream.abort()
+		case route.acceptCh <- stream:
+		default: //The backlog is full; Don't delay the session's other streams
+			stream.abort()
+		}
+	}
+}
+
+//muxRoute is the net.Listener returned by MuxListener.Listen
+type muxRoute struct {
+	owner     *MuxListener
+	name      string
+	acceptCh  chan *MuxStream
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ net.Listener = (*muxRoute)(nil)
+
+//Accept waits for and returns the next stream opened with the route's name
+func (route *muxRoute) Accept() (net.Conn, error) {
+	select {
+	case stream := <-route.acceptCh:
+		return stream, nil
+	case <-route.done:
+		return nil, fmt.Errorf("MuxListener: Listener for streams named %q is closed; Details: %w", route.name, net.ErrClosed)
+	}
+}
+
+//Close stops accepting streams with the route's name, queued streams are reset
+func (route *muxRoute) Close() error {
+	route.owner.lock.Lock()
+	if route.owner.routes[route.name] == route {
+		delete(route.owner.routes, route.name)
+	}
+	route.owner.lock.Unlock()
+
+	route.closeOnce.Do(func() { close(route.done) })
+	for {
+		select {
+		case stream := <-route.acceptCh:
+			stream.abort()
+		default:
+			return nil
+		}
+	}
+}
+
+//Addr returns the address of the underlying listener
+func (route *muxRoute) Addr() net.Addr {
+	return route.owner.Addr()
+}
@@ -0,0 +1,88 @@
+// +build !js,!wasm
+
+package wasmws
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//remoteAddr returns the address of the client that made the provided request.
+// If the request came from a trusted proxy the Forwarded (RFC 7239) or, in its
+// absence, X-Forwarded-For headers are walked from the nearest hop outward until
+// an address that is not a trusted proxy is found.
+func remoteAddr(req *http.Request, trustedProxies []*net.IPNet) net.Addr {
+	addr := parseHostAddr(req.RemoteAddr)
+	if addr == nil {
+		return wsAddr(req.RemoteAddr)
+	}
+
+	hops := forwardedHops(req.Header)
+	for i := len(hops) - 1; i >= 0 && isTrustedProxy(addr.IP, trustedProxies); i-- {
+		hop := parseHostAddr(hops[i])
+		if hop == nil {
+			break
+		}
+		addr = hop
+	}
+	return addr
+}
+
+//forwardedHops returns the client address followed by the addresses of each
+// proxy a request traversed, as reported by the request's forwarding headers.
+func forwardedHops(header http.Header) []string {
+	var hops []string
+	if forwarded := header["Forwarded"]; len(forwarded) > 0 {
+		for _, value := range forwarded {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					if kv := strings.SplitN(strings.TrimSpace(pair), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+						hops = append(hops, kv[1])
+					}
+				}
+			}
+		}
+		return hops
+	}
+
+	for _, value := range header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+//parseHostAddr parses an IP address with an optional port in any of the forms
+// found in RemoteAddr and forwarding headers, ex. "192.0.2.1", "192.0.2.1:80",
+// "2001:db8::1" or "[2001:db8::1]:80"; nil is returned for anything else, such
+// as obfuscated identifiers or "unknown".
+func parseHostAddr(hostAddr string) *net.TCPAddr {
+	hostAddr = strings.Trim(strings.TrimSpace(hostAddr), `"`)
+	if ip := net.ParseIP(strings.Trim(hostAddr, "[]")); ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+
+	host, portStr, err := net.SplitHostPort(hostAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	port, _ := strconv.Atoi(portStr)
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+//isTrustedProxy returns true if the provided IP is contained by a trusted network
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, trusted := range trustedProxies {
+		if trusted.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
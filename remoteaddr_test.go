@@ -0,0 +1,41 @@
+// +build !js,!wasm
+
+package wasmws
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestRemoteAddr(t *testing.T) {
+	_, proxyNet, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("Could not parse test proxy network; Details: %s", err)
+	}
+	trusted := []*net.IPNet{proxyNet}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		trusted    []*net.IPNet
+		expected   string
+	}{
+		{"direct", "192.0.2.1:1234", nil, trusted, "192.0.2.1:1234"},
+		{"untrusted peer", "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, trusted, "192.0.2.1:1234"},
+		{"no trusted proxies", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, nil, "10.0.0.1:1234"},
+		{"x-forwarded-for", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.7, 10.0.0.2"}}, trusted, "198.51.100.7:0"},
+		{"x-forwarded-for spoofed", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.9, 198.51.100.7"}}, trusted, "198.51.100.7:0"},
+		{"forwarded", "10.0.0.1:1234", http.Header{"Forwarded": {`for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`}}, trusted, "[2001:db8::1]:4711"},
+		{"forwarded obfuscated", "10.0.0.1:1234", http.Header{"Forwarded": {"for=_hidden, for=10.0.0.2"}}, trusted, "10.0.0.2:0"},
+		{"forwarded preferred", "10.0.0.1:1234", http.Header{"Forwarded": {"for=198.51.100.7"}, "X-Forwarded-For": {"203.0.113.9"}}, trusted, "198.51.100.7:0"},
+	}
+
+	for _, test := range tests {
+		req := &http.Request{RemoteAddr: test.remoteAddr, Header: test.header}
+		if actual := remoteAddr(req, test.trusted).String(); actual != test.expected {
+			t.Errorf("%s: remote address was %q rather than %q", test.name, actual, test.expected)
+		}
+	}
+}
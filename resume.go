@@ -0,0 +1,812 @@
+package wasmws
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+//Resumable connections layer a small framing protocol on top of a websocket
+// connection so that a session can survive the websocket being replaced: Both
+// sides number the bytes of their stream and retain written bytes in a bounded
+// replay buffer until the peer acknowledges having consumed them. If the
+// websocket is lost, the client redials and sends a hello frame with the session
+// ID and how much it has received; The server attaches the new websocket to the
+// existing session, replies with how much it has received and both sides
+// retransmit whatever the other is missing.
+//
+// Frame format: type (1 byte) | value (8 bytes) | payload length (4 bytes) | payload
+//  hello: value is the sender's received offset, payload is the session ID
+//  data:  value is the stream offset of the first payload byte
+//  ack:   value is the stream offset the sender has consumed up to
+//  close: the session was closed by the sender
+//  reset: the session ID in a hello is unknown (ex. expired)
+
+var (
+	//ErrSessionClosed is returned when operations are performed on a closed resumable connection
+	ErrSessionClosed = errors.New("WebSocket: Resumable session is closed")
+
+	//ErrSessionExpired is returned when a resumable connection could not be resumed before its timeout
+	ErrSessionExpired = errors.New("WebSocket: Resumable session expired before it could be resumed")
+
+	//errSessionIdentity is reported when a client attempts to resume a session
+	// another identity started
+	errSessionIdentity = errors.New("WebSocket: Resumable session was started by a different identity")
+)
+
+//ResumeOptions configures resumable connections; See: DialResumable and
+// ListenerOptions.Resume. The zero value uses the defaults.
+type ResumeOptions struct {
+	//Timeout is how long a session may be disconnected before it fails; Clients
+	// keep redialing and servers keep the session until it elapses. Defaults to 30s.
+	Timeout time.Duration
+
+	//ReplayBufferSize is the maximum number of bytes that have been written but
+	// not yet consumed by the peer. Writes block while it is full. Defaults to 1MiB.
+	ReplayBufferSize int
+}
+
+const (
+	defaultResumeTimeout    = time.Second * 30
+	defaultReplayBufferSize = 1024 * 1024
+
+	resumeHandshakeTimeout = time.Second * 10
+	resumeAckDelay         = time.Millisecond * 50 //Acks are delayed to coalesce them...
+	resumeAckBytes         = 16 * 1024             //...unless at least this much has been consumed
+	resumeMaxBackoff       = time.Second * 5
+
+	frameHeaderSize = 13
+	maxFramePayload = 32 * 1024
+)
+
+const (
+	frameHello byte = iota + 1
+	frameData
+	frameAck
+	frameClose
+	frameReset
+)
+
+//sessionID identifies a resumable session, the zero value requests a new session
+type sessionID [16]byte
+
+//withDefaults returns a copy of the options with unset fields defaulted
+func (opts *ResumeOptions) withDefaults() ResumeOptions {
+	var resolved ResumeOptions
+	if opts != nil {
+		resolved = *opts
+	}
+	if resolved.Timeout <= 0 {
+		resolved.Timeout = defaultResumeTimeout
+	}
+	if resolved.ReplayBufferSize <= 0 {
+		resolved.ReplayBufferSize = defaultReplayBufferSize
+	}
+	return resolved
+}
+
+//resumableConn is a net.Conn whose underlying websocket (transport) can be replaced
+// without losing data; See the top of this file for an overview.
+type resumableConn struct {
+	id       sessionID
+	opts     ResumeOptions
+	redial   func(context.Context) (net.Conn, error) //Only set for clients
+	onDone   func()                                  //Called once the session has ended
+	identity interface{}                             //Server only: The Authenticator identity that started the session
+
+	writeLock sync.Mutex //Serializes Write calls
+	frameLock sync.Mutex //Serializes frame writes to the transport
+
+	counters *connCounters //Counts data written and received through the session
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	transport    net.Conn
+	addrs        [2]net.Addr //local, remote of the latest transport
+	expiry       *time.Timer //Server only: fails the session if not resumed in time
+	noResume     bool        //Server only: the session can no longer be resumed
+	reconnecting bool
+
+	sendBuf    []byte //Bytes not yet consumed by the peer, sendBuf[0] is at offset sendAcked
+	sendAcked  uint64
+	sendOffset uint64
+
+	recvBuf     bytes.Buffer //Bytes received but not yet read
+	recvOffset  uint64
+	ackedOffset uint64 //Consumed offset last sent in an ack
+	ackPending  bool
+
+	localClosed, remoteClosed, done bool
+	err                             error
+	readDeadline, writeDeadline     deadline
+}
+
+var _ net.Conn = (*resumableConn)(nil)
+
+//newResumableConn returns a session that still needs a transport attached
+func newResumableConn(id sessionID, opts ResumeOptions, redial func(context.Context) (net.Conn, error), onDone func()) *resumableConn {
+	rc := &resumableConn{
+		id:       id,
+		opts:     opts,
+		redial:   redial,
+		onDone:   onDone,
+		counters: newConnCounters(),
+	}
+	rc.cond = sync.NewCond(&rc.mu)
+	return rc
+}
+
+//newSessionID returns a new random session ID
+func newSessionID() (sessionID, error) {
+	var id sessionID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, fmt.Errorf("WebSocket: Could not generate session ID; Details: %w", err)
+	}
+	return id, nil
+}
+
+//dialResumable dials a new resumable session with the provided dial function,
+// which is also used to redial when the session needs to be resumed.
+func dialResumable(ctx context.Context, opts *ResumeOptions, dial func(context.Context) (net.Conn, error)) (net.Conn, error) {
+	transport, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	id, peerRecvOffset, err := clientHello(transport, sessionID{}, 0)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+
+	rc := newResumableConn(id, opts.withDefaults(), dial, nil)
+	if err = rc.attach(transport, peerRecvOffset, false); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+//clientHello sends a hello for the provided session and returns the server's
+// session ID and received offset from its reply
+func clientHello(transport net.Conn, id sessionID, recvOffset uint64) (sessionID, uint64, error) {
+	transport.SetDeadline(time.Now().Add(resumeHandshakeTimeout))
+	defer transport.SetDeadline(time.Time{})
+
+	if err := writeFrame(transport, frameHello, recvOffset, id[:]); err != nil {
+		return id, 0, fmt.Errorf("WebSocket: Could not send resumable session hello; Details: %w", err)
+	}
+
+	typ, peerRecvOffset, payload, err := readFrame(transport)
+	switch {
+	case err != nil:
+		return id, 0, fmt.Errorf("WebSocket: Could not receive resumable session hello; Details: %w", err)
+	case typ == frameReset:
+		return id, 0, ErrSessionExpired
+	case typ != frameHello || len(payload) != len(id):
+		return id, 0, fmt.Errorf("WebSocket: Expected resumable session hello but received frame type %d", typ)
+	}
+	copy(id[:], payload)
+	return id, peerRecvOffset, nil
+}
+
+//attach makes the provided transport the current one, replacing any previous
+// transport, and retransmits anything the peer has not received. Servers send
+// their hello before retransmitting.
+func (rc *resumableConn) attach(transport net.Conn, peerRecvOffset uint64, sendHello bool) error {
+	rc.frameLock.Lock()
+	defer rc.frameLock.Unlock()
+
+	rc.mu.Lock()
+	if rc.done {
+		rc.mu.Unlock()
+		transport.Close()
+		return ErrSessionClosed
+	}
+	if peerRecvOffset < rc.sendAcked || peerRecvOffset > rc.sendOffset {
+		rc.mu.Unlock()
+		transport.Close()
+		return fmt.Errorf("WebSocket: Peer resumed session at offset %d which is outside of the replay buffer (%d-%d)", peerRecvOffset, rc.sendAcked, rc.sendOffset)
+	}
+
+	rc.trimLocked(peerRecvOffset)
+	old := rc.transport
+	rc.transport, rc.reconnecting = transport, false
+	rc.addrs = [2]net.Addr{transport.LocalAddr(), transport.RemoteAddr()}
+	if rc.expiry != nil {
+		rc.expiry.Stop()
+		rc.expiry = nil
+	}
+	recvOffset, replayOffset, closing := rc.recvOffset, rc.sendAcked, rc.localClosed
+	replay := append([]byte(nil), rc.sendBuf...)
+	rc.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	var err error
+	if sendHello {
+		err = writeFrame(transport, frameHello, recvOffset, rc.id[:])
+	}
+	for len(replay) > 0 && err == nil {
+		size := len(replay)
+		if size > maxFramePayload {
+			size = maxFramePayload
+		}
+		err = writeFrame(transport, frameData, replayOffset, replay[:size])
+		replay, replayOffset = replay[size:], replayOffset+uint64(size)
+	}
+
+	if closing { //Closed while disconnected, finish closing now the data is sent
+		if err == nil {
+			writeFrame(transport, frameClose, 0, nil)
+		}
+		rc.mu.Lock()
+		rc.endLocked()
+		rc.mu.Unlock()
+		return nil
+	}
+	go rc.readLoop(transport)
+	if err != nil {
+		rc.transportFailed(transport)
+	}
+	return nil
+}
+
+//readLoop processes frames from the provided transport until it fails
+func (rc *resumableConn) readLoop(transport net.Conn) {
+	for {
+		typ, value, payload, err := readFrame(transport)
+		if err != nil {
+			rc.transportFailed(transport)
+			return
+		}
+
+		rc.mu.Lock()
+		if rc.transport != transport { //Replaced, the peer will retransmit on the new one
+			rc.mu.Unlock()
+			return
+		}
+
+		switch typ {
+		case frameData:
+			if value > rc.recvOffset {
+				rc.failLocked(fmt.Errorf("WebSocket: Resumable session received data at offset %d but expected %d", value, rc.recvOffset))
+				rc.mu.Unlock()
+				return
+			}
+			if skip := rc.recvOffset - value; skip < uint64(len(payload)) {
+				rc.counters.received(len(payload)-int(skip), true)
+				rc.recvBuf.Write(payload[skip:])
+				rc.recvOffset += uint64(len(payload)) - skip
+				rc.cond.Broadcast()
+			}
+
+		case frameAck:
+			if value >= rc.sendAcked && value <= rc.sendOffset {
+				rc.trimLocked(value)
+				rc.cond.Broadcast()
+			}
+
+		case frameClose:
+			rc.remoteClosed = true
+			rc.endLocked()
+			rc.mu.Unlock()
+			return
+
+		default:
+			rc.failLocked(fmt.Errorf("WebSocket: Resumable session received unexpected frame type %d", typ))
+			rc.mu.Unlock()
+			return
+		}
+		rc.mu.Unlock()
+	}
+}
+
+//transportFailed detaches the provided transport (if still current) and starts
+// resumption; Clients redial, servers wait for the client to do so.
+func (rc *resumableConn) transportFailed(transport net.Conn) {
+	transport.Close()
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.transport != transport || rc.done {
+		return
+	}
+	rc.transport = nil
+
+	if rc.redial == nil {
+		if rc.noResume {
+			rc.failLocked(ErrSessionExpired)
+			return
+		}
+		rc.expiry = time.AfterFunc(rc.opts.Timeout, func() {
+			rc.mu.Lock()
+			defer rc.mu.Unlock()
+			if rc.transport == nil {
+				rc.failLocked(ErrSessionExpired)
+			}
+		})
+		return
+	}
+	if !rc.reconnecting {
+		rc.reconnecting = true
+		go rc.reconnect()
+	}
+}
+
+//reconnect redials with backoff until the session is resumed or times out
+func (rc *resumableConn) reconnect() {
+	deadline := time.Now().Add(rc.opts.Timeout)
+	backoff := time.Millisecond * 100
+	for {
+		rc.mu.Lock()
+		done, recvOffset := rc.done, rc.recvOffset
+		rc.mu.Unlock()
+		if done {
+			return
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), remaining)
+		transport, err := rc.redial(ctx)
+		cancel()
+
+		if err == nil {
+			var peerRecvOffset uint64
+			if _, peerRecvOffset, err = clientHello(transport, rc.id, recvOffset); err != nil {
+				transport.Close()
+				if err == ErrSessionExpired { //The server no longer has the session
+					break
+				}
+			} else {
+				if err = rc.attach(transport, peerRecvOffset, false); err != nil { //The session can't continue
+					rc.mu.Lock()
+					rc.failLocked(err)
+					rc.mu.Unlock()
+				}
+				return
+			}
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > resumeMaxBackoff {
+			backoff = resumeMaxBackoff
+		}
+	}
+
+	rc.mu.Lock()
+	rc.failLocked(ErrSessionExpired)
+	rc.mu.Unlock()
+}
+
+//trimLocked discards replay buffer bytes the peer has consumed; Hold mu!
+func (rc *resumableConn) trimLocked(peerOffset uint64) {
+	rc.sendBuf = rc.sendBuf[peerOffset-rc.sendAcked:]
+	rc.sendAcked = peerOffset
+	if len(rc.sendBuf) == 0 {
+		rc.sendBuf = rc.sendBuf[:0:0] //Release memory of an idle session
+	}
+}
+
+//failLocked ends the session with the provided error; Hold mu!
+func (rc *resumableConn) failLocked(err error) {
+	if rc.err == nil {
+		rc.err = err
+	}
+	rc.endLocked()
+}
+
+//endLocked releases the transport and timers of a finished session; Hold mu!
+func (rc *resumableConn) endLocked() {
+	if rc.done {
+		return
+	}
+	rc.done = true
+	if rc.transport != nil {
+		rc.transport.Close()
+		rc.transport = nil
+	}
+	if rc.expiry != nil {
+		rc.expiry.Stop()
+	}
+	rc.readDeadline.set(time.Time{}, nil)
+	rc.writeDeadline.set(time.Time{}, nil)
+	rc.cond.Broadcast()
+	if rc.onDone != nil {
+		go rc.onDone()
+	}
+}
+
+//scheduleAckLocked arranges for the consumed offset to be acknowledged; Hold mu!
+func (rc *resumableConn) scheduleAckLocked() {
+	consumed := rc.recvOffset - uint64(rc.recvBuf.Len())
+	if rc.ackPending || consumed == rc.ackedOffset {
+		return
+	}
+	rc.ackPending = true
+
+	delay := resumeAckDelay
+	if consumed-rc.ackedOffset >= resumeAckBytes {
+		delay = 0
+	}
+	time.AfterFunc(delay, func() {
+		rc.mu.Lock()
+		rc.ackPending = false
+		rc.ackedOffset = rc.recvOffset - uint64(rc.recvBuf.Len())
+		transport, ackedOffset := rc.transport, rc.ackedOffset
+		rc.mu.Unlock()
+
+		if transport != nil {
+			rc.writeTransportFrame(transport, frameAck, ackedOffset, nil)
+		}
+	})
+}
+
+//writeTransportFrame writes a frame to the provided transport, if this fails the
+// transport is considered lost
+func (rc *resumableConn) writeTransportFrame(transport net.Conn, typ byte, value uint64, payload []byte) {
+	rc.frameLock.Lock()
+	err := writeFrame(transport, typ, value, payload)
+	rc.frameLock.Unlock()
+
+	if err != nil {
+		rc.transportFailed(transport)
+	}
+}
+
+//Read implements the standard io.Reader interface (typical semantics)
+func (rc *resumableConn) Read(buf []byte) (int, error) {
+	if len(buf) < 1 {
+		return 0, nil
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for rc.recvBuf.Len() < 1 {
+		switch {
+		case rc.localClosed:
+			return 0, ErrSessionClosed
+		case rc.remoteClosed:
+			return 0, io.EOF
+		case rc.err != nil:
+			return 0, rc.err
+		case rc.readDeadline.expired:
+			return 0, timeoutError{}
+		}
+		rc.cond.Wait()
+	}
+
+	n, _ := rc.recvBuf.Read(buf)
+	rc.scheduleAckLocked()
+	return n, nil
+}
+
+//Write implements the standard io.Writer interface. Writes return once the data
+// is in the replay buffer and block while it is full.
+func (rc *resumableConn) Write(buf []byte) (n int, err error) {
+	rc.writeLock.Lock()
+	defer rc.writeLock.Unlock()
+
+	for len(buf) > 0 {
+		rc.mu.Lock()
+		for {
+			switch {
+			case rc.localClosed || rc.remoteClosed:
+				err = ErrSessionClosed
+			case rc.err != nil:
+				err = rc.err
+			case rc.writeDeadline.expired:
+				err = timeoutError{}
+			}
+			if err != nil {
+				rc.mu.Unlock()
+				return n, err
+			}
+			if len(rc.sendBuf) < rc.opts.ReplayBufferSize {
+				break
+			}
+			rc.cond.Wait()
+		}
+
+		size := rc.opts.ReplayBufferSize - len(rc.sendBuf)
+		if size > len(buf) {
+			size = len(buf)
+		}
+		if size > maxFramePayload {
+			size = maxFramePayload
+		}
+		offset := rc.sendOffset
+		rc.sendBuf = append(rc.sendBuf, buf[:size]...)
+		rc.sendOffset += uint64(size)
+		transport := rc.transport
+		rc.mu.Unlock()
+		rc.counters.sent(size, true)
+
+		if transport != nil { //Otherwise this is sent when the session is resumed
+			rc.writeTransportFrame(transport, frameData, offset, buf[:size])
+		}
+		buf, n = buf[size:], n+size
+	}
+	return n, nil
+}
+
+//Close closes the session, the peer's reads will return io.EOF once it has
+// received everything written. If the websocket is being replaced, the remaining
+// data and the closure are sent once the session is resumed; The session fails
+// instead if that does not happen within the timeout.
+func (rc *resumableConn) Close() error {
+	rc.mu.Lock()
+	if rc.localClosed || rc.done {
+		rc.localClosed = true
+		rc.mu.Unlock()
+		return nil
+	}
+	rc.localClosed = true
+	transport := rc.transport
+	if transport == nil { //Finished by attach once resumed
+		rc.cond.Broadcast()
+		rc.mu.Unlock()
+		return nil
+	}
+	rc.transport = nil //Keeps endLocked from closing it before the close frame is sent
+	rc.endLocked()
+	rc.mu.Unlock()
+
+	if transport != nil {
+		rc.frameLock.Lock()
+		writeFrame(transport, frameClose, 0, nil)
+		rc.frameLock.Unlock()
+		transport.Close()
+	}
+	return nil
+}
+
+//LocalAddr returns the local address of the current (or last) websocket
+func (rc *resumableConn) LocalAddr() net.Addr {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.addrs[0]
+}
+
+//RemoteAddr returns the remote address of the current (or last) websocket
+func (rc *resumableConn) RemoteAddr() net.Addr {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.addrs[1]
+}
+
+//SetDeadline implements the Conn SetDeadline method
+func (rc *resumableConn) SetDeadline(future time.Time) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.readDeadline.set(future, rc.cond)
+	rc.writeDeadline.set(future, rc.cond)
+	return nil
+}
+
+//SetReadDeadline implements the Conn SetReadDeadline method
+func (rc *resumableConn) SetReadDeadline(future time.Time) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.readDeadline.set(future, rc.cond)
+	return nil
+}
+
+//SetWriteDeadline implements the Conn SetWriteDeadline method
+func (rc *resumableConn) SetWriteDeadline(future time.Time) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.writeDeadline.set(future, rc.cond)
+	return nil
+}
+
+//Stats returns the statistics of the session: Bytes and messages count the data
+// written and received through the session (retransmissions are excluded) across
+// all of its websockets and ConnectedAt is when the session started, while
+// Compressed and BufferedAmount are those of the current websocket.
+func (rc *resumableConn) Stats() ConnStats {
+	stats := rc.counters.stats()
+	if transport, ok := rc.NetConn().(interface{ Stats() ConnStats }); ok {
+		current := transport.Stats()
+		stats.Compressed, stats.BufferedAmount = current.Compressed, current.BufferedAmount
+	}
+	return stats
+}
+
+//NetConn returns the current websocket connection of the session (or nil), this
+// allows the metadata of the websocket to be accessed; See: UpgradeRequest
+func (rc *resumableConn) NetConn() net.Conn {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.transport
+}
+
+//deadline tracks a deadline and wakes waiters on the provided condition when
+// it expires; All methods must be called while holding the condition's lock.
+type deadline struct {
+	timer   *time.Timer
+	expired bool
+}
+
+//set replaces the deadline, the zero time clears it
+func (dl *deadline) set(future time.Time, cond *sync.Cond) {
+	if dl.timer != nil {
+		dl.timer.Stop()
+		dl.timer = nil
+	}
+	dl.expired = false
+	if future.IsZero() || cond == nil {
+		return
+	}
+
+	wait := time.Until(future)
+	if wait <= 0 {
+		dl.expired = true
+		cond.Broadcast()
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(wait, func() {
+		cond.L.Lock()
+		defer cond.L.Unlock()
+		if dl.timer == timer { //Not replaced since
+			dl.expired = true
+			cond.Broadcast()
+		}
+	})
+	dl.timer = timer
+}
+
+//writeFrame writes a single frame, the header and payload are sent in one write
+// so that each frame is a single websocket message
+func writeFrame(wtr io.Writer, typ byte, value uint64, payload []byte) error {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint64(frame[1:], value)
+	binary.BigEndian.PutUint32(frame[9:], uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+	_, err := wtr.Write(frame)
+	return err
+}
+
+//readFrame reads a single frame
+func readFrame(rdr io.Reader) (typ byte, value uint64, payload []byte, err error) {
+	var header [frameHeaderSize]byte
+	if _, err = io.ReadFull(rdr, header[:]); err != nil {
+		return 0, 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[9:])
+	if size > maxFramePayload {
+		return 0, 0, nil, fmt.Errorf("WebSocket: Resumable session frame of %d bytes exceeds maximum of %d", size, maxFramePayload)
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(rdr, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return header[0], binary.BigEndian.Uint64(header[1:]), payload, nil
+}
+
+//sessionRegistry tracks the resumable sessions of a listener so that reconnecting
+// clients can be attached to them
+type sessionRegistry struct {
+	opts ResumeOptions
+
+	lock     sync.Mutex
+	sessions map[sessionID]*resumableConn
+}
+
+//newSessionRegistry returns an empty registry for sessions using the provided options
+func newSessionRegistry(opts *ResumeOptions) *sessionRegistry {
+	return &sessionRegistry{
+		opts:     opts.withDefaults(),
+		sessions: make(map[sessionID]*resumableConn),
+	}
+}
+
+//serve reads the client's hello from the provided transport and either attaches
+// it to the existing session it names or starts a new one. New sessions are
+// returned so they can be accepted; nil is returned for resumed sessions. A
+// session may only be resumed by a request whose identity (as attached by the
+// listener's Authenticator) is equal to that of the request that started it.
+func (reg *sessionRegistry) serve(transport net.Conn, identity interface{}) (*resumableConn, error) {
+	transport.SetReadDeadline(time.Now().Add(resumeHandshakeTimeout))
+	typ, peerRecvOffset, payload, err := readFrame(transport)
+	transport.SetReadDeadline(time.Time{})
+	if err != nil {
+		transport.Close()
+		return nil, fmt.Errorf("WebSocket: Could not receive resumable session hello; Details: %w", err)
+	}
+	var id sessionID
+	if typ != frameHello || len(payload) != len(id) {
+		transport.Close()
+		return nil, fmt.Errorf("WebSocket: Expected resumable session hello but received frame type %d", typ)
+	}
+	copy(id[:], payload)
+
+	//Resume?
+	if id != (sessionID{}) {
+		reg.lock.Lock()
+		rc, found := reg.sessions[id]
+		reg.lock.Unlock()
+		if !found {
+			writeFrame(transport, frameReset, 0, nil)
+			transport.Close()
+			return nil, ErrSessionExpired
+		}
+		if !reflect.DeepEqual(rc.identity, identity) { //Don't reveal the session exists
+			writeFrame(transport, frameReset, 0, nil)
+			transport.Close()
+			return nil, errSessionIdentity
+		}
+		return nil, rc.attach(transport, peerRecvOffset, true)
+	}
+
+	//New session
+	if id, err = newSessionID(); err != nil {
+		transport.Close()
+		return nil, err
+	}
+	rc := newResumableConn(id, reg.opts, nil, func() {
+		reg.lock.Lock()
+		delete(reg.sessions, id)
+		reg.lock.Unlock()
+	})
+	rc.identity = identity
+	reg.lock.Lock()
+	reg.sessions[id] = rc
+	reg.lock.Unlock()
+
+	if err = rc.attach(transport, 0, true); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+//close ends the sessions awaiting resumption and those that lose their websocket
+// later, as is done once the listener no longer accepts resumes
+func (reg *sessionRegistry) close() {
+	for _, rc := range reg.list() {
+		rc.mu.Lock()
+		rc.noResume = true
+		if rc.transport == nil {
+			rc.failLocked(ErrSessionExpired)
+		}
+		rc.mu.Unlock()
+	}
+}
+
+//closeAll closes every session in the registry, those awaiting resumption end
+// immediately since they can no longer be resumed
+func (reg *sessionRegistry) closeAll() {
+	for _, rc := range reg.list() {
+		rc.Close()
+		rc.mu.Lock()
+		rc.endLocked()
+		rc.mu.Unlock()
+	}
+}
+
+//list returns the sessions in the registry
+func (reg *sessionRegistry) list() []*resumableConn {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	sessions := make([]*resumableConn, 0, len(reg.sessions))
+	for _, rc := range reg.sessions {
+		sessions = append(sessions, rc)
+	}
+	return sessions
+}
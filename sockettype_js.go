@@ -47,7 +47,4 @@ func (st socketType) String() string {
 //Set sets the type of the provided JavaScript websocket to itself
 func (st socketType) Set(websocket js.Value) {
 	websocket.Set("binaryType", st.String())
-	if debugVerbose {
-		println("Websocket: Set websocket binaryType (mode) to", st.String())
-	}
 }
@@ -0,0 +1,109 @@
+package wasmws
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//ConnStats are statistics of a single websocket connection; See: WebSocket.Stats
+// and WebSockConn.Stats. Fields documented as browser only are always zero for
+// native (non-WASM) connections.
+type ConnStats struct {
+	BytesSent        int64 //BytesSent is the number of message payload bytes sent
+	BytesReceived    int64 //BytesReceived is the number of message payload bytes received
+	MessagesSent     int64 //MessagesSent is the number of websocket messages sent
+	MessagesReceived int64 //MessagesReceived is the number of websocket messages received
+
+	BlobReads          int64 //BlobReads is the number of messages received as Blobs (Browser only)
+	ArrayBufferReads   int64 //ArrayBufferReads is the number of messages received as ArrayBuffers (Browser only)
+	ReadQueueHighWater int64 //ReadQueueHighWater is the most messages that have waited to be Read at once (Browser only)
+	BufferedAmount     int64 //BufferedAmount is the number of bytes queued by the browser for sending (Browser only)
+
+	ConnectedAt  time.Time     //ConnectedAt is when the websocket connected
+	Connected    time.Duration //Connected is how long the websocket has been connected
+	LastActivity time.Time     //LastActivity is when a message was last sent or received
+
+	Compressed bool //Compressed is true if the permessage-deflate extension was negotiated
+}
+
+//deflateNegotiated returns true if the provided Sec-WebSocket-Extensions value
+// of a websocket handshake response includes the permessage-deflate extension
+func deflateNegotiated(extensions string) bool {
+	for _, extension := range strings.Split(extensions, ",") {
+		if params := strings.SplitN(extension, ";", 2); strings.TrimSpace(params[0]) == "permessage-deflate" {
+			return true
+		}
+	}
+	return false
+}
+
+//connCounters tracks the statistics of a connection, it is safe for concurrent use
+type connCounters struct {
+	//64-bit values accessed atomically come first to guarantee their alignment
+	bytesSent, bytesReceived       int64
+	messagesSent, messagesReceived int64
+	blobReads, arrayBufferReads    int64
+	readQueued, readQueueHighWater int64
+	lastActivity                   int64 //UnixNano
+
+	connectedAt time.Time
+	compressed  bool //Set before the counters are shared
+}
+
+//newConnCounters returns counters for a connection that connected now
+func newConnCounters() *connCounters {
+	now := time.Now()
+	return &connCounters{connectedAt: now, lastActivity: now.UnixNano()}
+}
+
+//sent records the sending of a message, or part of one
+func (cc *connCounters) sent(bytes int, message bool) {
+	atomic.AddInt64(&cc.bytesSent, int64(bytes))
+	if message {
+		atomic.AddInt64(&cc.messagesSent, 1)
+	}
+	atomic.StoreInt64(&cc.lastActivity, time.Now().UnixNano())
+}
+
+//received records the receipt of a message, or part of one
+func (cc *connCounters) received(bytes int, message bool) {
+	atomic.AddInt64(&cc.bytesReceived, int64(bytes))
+	if message {
+		atomic.AddInt64(&cc.messagesReceived, 1)
+	}
+	atomic.StoreInt64(&cc.lastActivity, time.Now().UnixNano())
+}
+
+//queued records a change in the number of messages waiting to be read
+func (cc *connCounters) queued(delta int64) {
+	queued := atomic.AddInt64(&cc.readQueued, delta)
+	for {
+		highWater := atomic.LoadInt64(&cc.readQueueHighWater)
+		if queued <= highWater || atomic.CompareAndSwapInt64(&cc.readQueueHighWater, highWater, queued) {
+			return
+		}
+	}
+}
+
+//lastActive returns when a message was last sent or received
+func (cc *connCounters) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&cc.lastActivity))
+}
+
+//stats returns a snapshot of the counters
+func (cc *connCounters) stats() ConnStats {
+	return ConnStats{
+		BytesSent:          atomic.LoadInt64(&cc.bytesSent),
+		BytesReceived:      atomic.LoadInt64(&cc.bytesReceived),
+		MessagesSent:       atomic.LoadInt64(&cc.messagesSent),
+		MessagesReceived:   atomic.LoadInt64(&cc.messagesReceived),
+		BlobReads:          atomic.LoadInt64(&cc.blobReads),
+		ArrayBufferReads:   atomic.LoadInt64(&cc.arrayBufferReads),
+		ReadQueueHighWater: atomic.LoadInt64(&cc.readQueueHighWater),
+		ConnectedAt:        cc.connectedAt,
+		Connected:          time.Since(cc.connectedAt),
+		LastActivity:       cc.lastActive(),
+		Compressed:         cc.compressed,
+	}
+}
@@ -0,0 +1,162 @@
+package wasmws
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+//ErrTunnelNotAllowed is returned by DialTunnel when the gateway's allowlist does
+// not permit connecting to the requested address
+var ErrTunnelNotAllowed = errors.New("WebSocket: Gateway does not allow connecting to the requested address")
+
+//SOCKS5 (RFC 1928) protocol values used by DialTunnel
+const (
+	socks5Version        = 5
+	socks5NoAuth         = 0
+	socks5Connect        = 1
+	socks5AddrIPv4       = 1
+	socks5AddrDomain     = 3
+	socks5AddrIPv6       = 4
+	socks5Succeeded      = 0
+	socks5NotAllowed     = 2
+	socks5MaxDomainBytes = 255
+)
+
+//socks5Replies describes the SOCKS5 reply codes indicating failure
+var socks5Replies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+//DialTunnel dials a websocket to a wasmws-gateway tunnel (ex. "wss://gateway/tunnel")
+// and asks the gateway to connect it to the provided TCP address in the form
+// "host:port". The returned connection carries the TCP connection's data. If the
+// gateway's allowlist does not permit the address, the error matches
+// ErrTunnelNotAllowed.
+func DialTunnel(ctx context.Context, gatewayURL, address string) (net.Conn, error) {
+	var dialer Dialer
+	return dialer.DialTunnel(ctx, gatewayURL, address)
+}
+
+//DialTunnel is DialTunnel using the Dialer's options; See: the package level
+// DialTunnel for details.
+func (d *Dialer) DialTunnel(ctx context.Context, gatewayURL, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("WebSocket: Invalid tunnel address %q; Details: %w", address, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("WebSocket: Invalid tunnel address %q; Details: Bad port: %w", address, err)
+	}
+	if len(host) > socks5MaxDomainBytes {
+		return nil, fmt.Errorf("WebSocket: Invalid tunnel address %q; Details: Host is longer than %d bytes", address, socks5MaxDomainBytes)
+	}
+
+	conn, err := d.DialContext(ctx, "websocket", gatewayURL)
+	if err != nil {
+		return nil, err
+	}
+
+	//Abort the handshake if the context ends
+	handshakeDone, watchDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-handshakeDone:
+		}
+	}()
+	err = socks5Handshake(conn, host, uint16(port))
+	close(handshakeDone)
+	<-watchDone
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket: Could not tunnel to %q via %q; Details: %w", address, gatewayURL, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+//socks5Handshake requests a connection to the provided host and port without
+// authentication
+func socks5Handshake(conn io.ReadWriter, host string, port uint16) error {
+	if _, err := conn.Write([]byte{socks5Version, 1, socks5NoAuth}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("Gateway replied with SOCKS version %d", reply[0])
+	}
+	if reply[1] != socks5NoAuth {
+		return errors.New("Gateway requires authentication")
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	switch ip := net.ParseIP(host); {
+	case ip == nil:
+		req = append(append(req, socks5AddrDomain, byte(len(host))), host...)
+	case ip.To4() != nil:
+		req = append(append(req, socks5AddrIPv4), ip.To4()...)
+	default:
+		req = append(append(req, socks5AddrIPv6), ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	//Reply: version | reply code | reserved | bound address type | bound address | bound port
+	reply = make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	switch {
+	case reply[0] != socks5Version:
+		return fmt.Errorf("Gateway replied with SOCKS version %d", reply[0])
+	case reply[1] == socks5NotAllowed:
+		return ErrTunnelNotAllowed
+	case reply[1] != socks5Succeeded:
+		if msg, found := socks5Replies[reply[1]]; found {
+			return fmt.Errorf("Gateway could not connect: %s", msg)
+		}
+		return fmt.Errorf("Gateway could not connect: Reply code %d", reply[1])
+	}
+
+	var boundSize int
+	switch reply[3] {
+	case socks5AddrIPv4:
+		boundSize = net.IPv4len
+	case socks5AddrIPv6:
+		boundSize = net.IPv6len
+	case socks5AddrDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return err
+		}
+		boundSize = int(size[0])
+	default:
+		return fmt.Errorf("Gateway replied with unknown address type %d", reply[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, boundSize+binary.Size(port)))
+	return err
+}
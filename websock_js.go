@@ -1,19 +1,25 @@
 package wasmws
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"sync"
+	"sync/atomic"
 	"syscall/js"
 	"time"
+	"unicode/utf8"
 )
 
 const (
-	socketStreamThresholdBytes = 1024  //If enabled, the Blob interface will be used when consecutive messages exceed this threshold
-	debugVerbose               = false //Set to true if you are debugging issues, this gates many prints that would kill performance
+	socketStreamThresholdBytes = 1024                  //If enabled, the Blob interface will be used when consecutive messages exceed this threshold (default of Dialer.StreamThreshold)
+	defaultReadQueueDepth      = 8                     //Number of received messages queued for Read (default of Dialer.ReadQueueDepth)
+	writeDrainPollInterval     = time.Millisecond * 10 //How often bufferedAmount is checked while a Write is blocked by backpressure
+	closeMessageTooBig         = 4009                  //Browsers may not send 1009 (message too big), so this application close code is sent instead
 )
 
 var (
@@ -21,12 +27,44 @@ var (
 	// interface to be used, if supported.
 	EnableBlobStreaming bool = true
 
+	//WriteHighWaterMark is the number of bytes queued by the browser for sending
+	// (the Websocket's bufferedAmount) above which Write blocks until the queue
+	// drains below WriteLowWaterMark. This prevents fast producers from queuing an
+	// unbounded amount of data in the browser. Zero or less disables backpressure.
+	WriteHighWaterMark = 4 * 1024 * 1024
+
+	//WriteLowWaterMark is the number of queued bytes a blocked Write waits for the
+	// browser's send queue to drain below; See: WriteHighWaterMark
+	WriteLowWaterMark = 1024 * 1024
+
 	//ErrWebsocketClosed is returned when operations are performed on a closed Websocket
 	ErrWebsocketClosed = errors.New("WebSocket: Web socket is closed")
 
 	blobSupported bool //set to true by init if browser supports the Blob interface
 )
 
+//CloseError is returned by WebSocket operations after the websocket has been
+// closed by the remote side (or the browser due to a failure), it provides the
+// details of the JavaScript CloseEvent: See https://developer.mozilla.org/en-US/docs/Web/API/CloseEvent
+// errors.Is(err, ErrWebsocketClosed) is true for a CloseError.
+type CloseError struct {
+	Code     int    //Code is the websocket close code, ex. 1000 (normal), 1006 (abnormal) or 4000-4999 (application defined)
+	Reason   string //Reason is the reason provided by the remote side, if any
+	WasClean bool   //WasClean is false if the connection was not closed with a closing handshake
+}
+
+func (err *CloseError) Error() string {
+	if err.Reason == "" {
+		return fmt.Sprintf("WebSocket: Web socket was closed with code %d (clean: %t)", err.Code, err.WasClean)
+	}
+	return fmt.Sprintf("WebSocket: Web socket was closed with code %d (clean: %t); Reason: %s", err.Code, err.WasClean, err.Reason)
+}
+
+//Unwrap allows CloseError to match ErrWebsocketClosed with errors.Is
+func (err *CloseError) Unwrap() error {
+	return ErrWebsocketClosed
+}
+
 //init checks to see if the browser hosting this application support the Websocket Blob interface
 func init() {
 	newBlob := js.Global().Get("Blob")
@@ -37,9 +75,6 @@ func init() {
 
 	testBlob := js.Global().Get("Blob").New()
 	blobSupported = !testBlob.Get("arrayBuffer").Equal(jsUndefined) && !testBlob.Get("stream").Equal(jsUndefined)
-	if debugVerbose {
-		println("Websocket: Init: EnableBlobStreaming is", EnableBlobStreaming, "and blobSupported is", blobSupported)
-	}
 }
 
 //WebSocket is a Go struct that wraps the web browser's JavaScript websocket object and provides a net.Conn interface
@@ -47,21 +82,32 @@ type WebSocket struct {
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 
-	URL        string
-	ws         js.Value
-	wsType     socketType
-	enableBlob bool
-	openCh     chan struct{}
+	URL             string
+	ws              js.Value
+	wsType          socketType
+	enableBlob      bool
+	streamThreshold int
+	openCh          chan struct{}
+	logger          Logger
 
-	readLock  sync.Mutex
-	remaining io.Reader
-	readCh    chan io.Reader
+	closeErr  *CloseError   //Set by handleClose before ctx is canceled
+	failErr   error         //Set by handleMessage before ctx is canceled if the websocket failed
+	counters  *connCounters //Set by handleOpen
+	readLimit int64         //Accessed atomically, the maximum size of received messages if positive
+
+	readLock      sync.Mutex
+	remaining     io.Reader
+	remainingType MessageType
+	readCh        chan jsMessage
 
 	readDeadlineTimer *time.Timer
 	newReadDeadlineCh chan time.Time
 
-	writeLock sync.Mutex
-	errCh     chan error
+	writeLock      sync.Mutex
+	errCh          chan error
+	writeType      MessageType
+	writeHighWater int
+	writeLowWater  int
 
 	writeDeadlineTimer *time.Timer
 	newWriteDeadlineCh chan time.Time
@@ -74,28 +120,65 @@ type WebSocket struct {
 // and "wss://host/path..." for secured websockets. If tunnel a TLS based protocol
 // over a "wss://..." websocket you will get TLS twice, once on the websocket using
 // the browsers TLS stack and another using the Go (or other compiled) TLS stack.
-func New(dialCtx context.Context, URL string) (*WebSocket, error) {
+//
+// Optionally, subprotocols may be provided that will be advertised to the server
+// in the order of preference (via the Sec-WebSocket-Protocol header). The browser
+// fails the connection if the server selects a subprotocol that was not offered,
+// however a server may still select none at all; See: WebSocket.Protocol
+//
+// To further tune the websocket use a Dialer.
+func New(dialCtx context.Context, URL string, subprotocols ...string) (*WebSocket, error) {
+	dialer := Dialer{Subprotocols: subprotocols}
+	return dialer.newWebSocket(dialCtx, URL)
+}
+
+//newWebSocket is the implementation of New that applies the Dialer's options
+func (d *Dialer) newWebSocket(dialCtx context.Context, URL string) (*WebSocket, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	ws := &WebSocket{
 		ctx:       ctx,
 		ctxCancel: cancel,
 
-		URL:        URL,
-		ws:         js.Global().Get("WebSocket").New(URL),
-		wsType:     socketTypeArrayBuffer,
-		enableBlob: EnableBlobStreaming && blobSupported,
-		openCh:     make(chan struct{}),
+		URL:             URL,
+		ws:              newJSWebSocket(URL, d.Subprotocols),
+		wsType:          socketTypeArrayBuffer,
+		enableBlob:      EnableBlobStreaming && !d.DisableBlobStreaming && blobSupported,
+		streamThreshold: socketStreamThresholdBytes,
+		openCh:          make(chan struct{}),
+		logger:          loggerOrNop(d.Logger),
 
-		readCh:            make(chan io.Reader, 8),
 		readDeadlineTimer: time.NewTimer(time.Minute),
 		newReadDeadlineCh: make(chan time.Time, 1),
 
 		errCh:              make(chan error, 1),
+		writeType:          MessageBinary,
+		writeHighWater:     WriteHighWaterMark,
+		writeLowWater:      WriteLowWaterMark,
 		writeDeadlineTimer: time.NewTimer(time.Minute),
 		newWriteDeadlineCh: make(chan time.Time, 1),
 
 		cleanup: make([]func(), 0, 3),
 	}
+	ws.SetReadLimit(d.ReadLimit)
+
+	//Apply the Dialer's overrides of the defaults
+	if d.StreamThreshold > 0 {
+		ws.streamThreshold = d.StreamThreshold
+	}
+	readQueueDepth := defaultReadQueueDepth
+	if d.ReadQueueDepth > 0 {
+		readQueueDepth = d.ReadQueueDepth
+	}
+	ws.readCh = make(chan jsMessage, readQueueDepth)
+	if d.MessageType == MessageText {
+		ws.writeType = MessageText
+	}
+	if d.WriteHighWaterMark != 0 {
+		ws.writeHighWater = d.WriteHighWaterMark
+	}
+	if d.WriteLowWaterMark != 0 {
+		ws.writeLowWater = d.WriteLowWaterMark
+	}
 
 	ws.wsType.Set(ws.ws)
 	ws.setDeadline(ws.readDeadlineTimer, time.Time{})
@@ -105,11 +188,11 @@ func New(dialCtx context.Context, URL string) (*WebSocket, error) {
 	ws.addHandler(ws.handleError, "error")
 	ws.addHandler(ws.handleMessage, "message")
 
+	ws.logger.Debug("WebSocket: Dialing", "url", ws.URL, "blobStreaming", ws.enableBlob, "blobSupported", blobSupported)
+
 	go func() { //handle shutdown
 		<-ws.ctx.Done()
-		if debugVerbose {
-			println("Websocket: Shutdown")
-		}
+		ws.logger.Debug("WebSocket: Shutdown", "url", ws.URL)
 
 		ws.ws.Call("close")
 		for _, cleanup := range ws.cleanup {
@@ -119,7 +202,7 @@ func New(dialCtx context.Context, URL string) (*WebSocket, error) {
 		for {
 			select {
 			case pending := <-ws.readCh:
-				if closer, hasClose := pending.(io.Closer); hasClose {
+				if closer, hasClose := pending.rdr.(io.Closer); hasClose {
 					closer.Close()
 				}
 				continue
@@ -133,42 +216,120 @@ func New(dialCtx context.Context, URL string) (*WebSocket, error) {
 	//Wait for connection or failure
 	select {
 	case <-ws.ctx.Done():
-		return nil, ErrWebsocketClosed
+		return nil, ws.closedError()
 
 	case <-dialCtx.Done():
+		ws.logger.Warn("WebSocket: Dial canceled", "url", ws.URL, "err", dialCtx.Err())
 		ws.ctxCancel()
 		return nil, dialCtx.Err()
 
 	case err := <-ws.errCh:
+		ws.logger.Warn("WebSocket: Dial failed", "url", ws.URL, "err", err)
 		ws.ctxCancel()
 		return nil, err
 
 	case <-ws.openCh:
-		if debugVerbose {
-			println("Websocket: Connected!")
-		}
+		ws.logger.Debug("WebSocket: Opened", "url", ws.URL, "protocol", ws.Protocol())
 	}
 
 	//Find out what kind of socket we are
 	if ws.wsType = newSocketType(ws.ws); ws.wsType == socketTypeUnknown {
-		if debugVerbose {
-			println("Websocket: Invalid socket type")
-		}
+		ws.logger.Error("WebSocket: Invalid socket type", "url", ws.URL, "binaryType", ws.ws.Get("binaryType").String())
 		ws.ctxCancel()
 		return nil, fmt.Errorf("WebSocket: %q's method 'websocket.binaryType' returned %q which is an invalid socket type!", ws.URL, ws.wsType)
 	}
 	return ws, nil
 }
 
+//newJSWebSocket constructs the browser's JavaScript websocket object with the
+// optional list of subprotocols: See https://developer.mozilla.org/en-US/docs/Web/API/WebSocket/WebSocket
+func newJSWebSocket(URL string, subprotocols []string) js.Value {
+	if len(subprotocols) < 1 {
+		return js.Global().Get("WebSocket").New(URL)
+	}
+
+	jsProtocols := make([]interface{}, len(subprotocols))
+	for i, protocol := range subprotocols {
+		jsProtocols[i] = protocol
+	}
+	return js.Global().Get("WebSocket").New(URL, jsProtocols)
+}
+
+//Protocol returns the subprotocol selected by the server during the opening
+// handshake, if any; See: https://developer.mozilla.org/en-US/docs/Web/API/WebSocket/protocol
+// An empty string is returned if the server did not select one of the subprotocols
+// offered to New, callers that require a subprotocol should treat this as a mismatch.
+func (ws *WebSocket) Protocol() string {
+	return ws.ws.Get("protocol").String()
+}
+
+//SetMessageType sets the type of messages sent by Write, by default binary
+// messages are sent. MessageText allows interoperating with peers that only
+// exchange text messages, such as JSON-over-WebSocket services; Each Write must
+// then be valid UTF-8. Read returns the content of both text and binary messages.
+// This should be called before the websocket is used.
+func (ws *WebSocket) SetMessageType(typ MessageType) error {
+	if typ != MessageBinary && typ != MessageText {
+		return fmt.Errorf("WebSocket: Invalid message type: %s", typ)
+	}
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	ws.writeType = typ
+	return nil
+}
+
 //Close shuts the websocket down
 func (ws *WebSocket) Close() error {
-	if debugVerbose {
-		println("Websocket: Internal close")
+	ws.logger.Debug("WebSocket: Closing", "url", ws.URL)
+	ws.ctxCancel()
+	return nil
+}
+
+//CloseWithReason shuts the websocket down sending the remote side the provided
+// close code and reason. Browsers only allow the code to be 1000 (normal closure)
+// or in the range 3000-4999, and the reason to be at most 123 bytes.
+func (ws *WebSocket) CloseWithReason(code int, reason string) error {
+	if code != 1000 && (code < 3000 || code > 4999) {
+		return fmt.Errorf("WebSocket: Invalid close code %d; Details: Only 1000 or 3000-4999 may be sent", code)
+	}
+	if len(reason) > 123 {
+		return fmt.Errorf("WebSocket: Close reason is %d bytes; Details: At most 123 bytes may be sent", len(reason))
 	}
+	ws.logger.Debug("WebSocket: Closing", "url", ws.URL, "code", code, "reason", reason)
+
+	ws.ws.Call("close", code, reason)
 	ws.ctxCancel()
 	return nil
 }
 
+//SetReadLimit sets the maximum size in bytes of a single received message, if
+// not positive no limit is enforced. If a larger message is received the
+// websocket is closed (with code 4009 as browsers may not send 1009, message too
+// big) and reads return an error matching ErrMessageTooBig. Larger messages are
+// not copied into Go memory.
+func (ws *WebSocket) SetReadLimit(limit int64) {
+	atomic.StoreInt64(&ws.readLimit, limit)
+}
+
+//closedError returns the error for operations on a closed websocket, this is a
+// *CloseError if the websocket was closed remotely
+func (ws *WebSocket) closedError() error {
+	if ws.failErr != nil {
+		return ws.failErr
+	}
+	if ws.closeErr != nil {
+		return ws.closeErr
+	}
+	return ErrWebsocketClosed
+}
+
+//Stats returns the statistics of the websocket
+func (ws *WebSocket) Stats() ConnStats {
+	stats := ws.counters.stats()
+	stats.BufferedAmount = int64(ws.ws.Get("bufferedAmount").Int())
+	return stats
+}
+
 //LocalAddr returns a dummy websocket address to satisfy net.Conn, see: wsAddr
 func (ws *WebSocket) LocalAddr() net.Addr {
 	return wsAddr(ws.URL)
@@ -180,23 +341,50 @@ func (ws *WebSocket) RemoteAddr() net.Addr {
 }
 
 //Write implements the standard io.Writer interface. Due to the JavaScript writes
-// being internally buffered it will never block and a write timeout from a
-// previous write may not surface until a subsequent write.
+// being internally buffered it will only block if the browser's send queue is
+// above WriteHighWaterMark and a write timeout from a previous write may not
+// surface until a subsequent write.
 func (ws *WebSocket) Write(buf []byte) (n int, err error) {
 	//Check for noop
-	writeCount := len(buf)
-	if writeCount < 1 {
+	if len(buf) < 1 {
 		return 0, nil
 	}
+	return ws.send(0, buf)
+}
+
+//WriteMessage sends the provided data as a single websocket message of the
+// provided type, this allows the websocket to be used as a message pipe rather
+// than a byte stream. Write deadlines and backpressure apply as they do to Write.
+// ErrInvalidUTF8 is returned for text that is not valid UTF-8.
+func (ws *WebSocket) WriteMessage(typ MessageType, msg []byte) error {
+	if typ != MessageBinary && typ != MessageText {
+		return fmt.Errorf("WebSocket: Invalid message type: %s", typ)
+	}
+	_, err := ws.send(typ, msg)
+	return err
+}
+
+//send sends the provided buffer as a single message, if the type is zero the
+// type set by SetMessageType is used; Only call from Write or WriteMessage!
+func (ws *WebSocket) send(typ MessageType, buf []byte) (n int, err error) {
+	writeCount := len(buf)
 
 	//Lock
 	ws.writeLock.Lock()
 	defer ws.writeLock.Unlock()
 
+	//Check the message
+	if typ == 0 {
+		typ = ws.writeType
+	}
+	if typ == MessageText && !utf8.Valid(buf) {
+		return 0, ErrInvalidUTF8
+	}
+
 	//Check for close or new deadline
 	select {
 	case <-ws.ctx.Done():
-		return 0, ErrWebsocketClosed
+		return 0, ws.closedError()
 
 	case newWriteDeadline := <-ws.newWriteDeadlineCh:
 		ws.setDeadline(ws.writeDeadlineTimer, newWriteDeadline)
@@ -204,15 +392,18 @@ func (ws *WebSocket) Write(buf []byte) (n int, err error) {
 	default:
 	}
 
+	//Wait for the browser to drain its send queue if it is too full
+	if err = ws.waitForDrain(); err != nil {
+		return 0, err
+	}
+
 	//Write
 	select {
 	case <-ws.ctx.Done():
-		return 0, ErrWebsocketClosed
+		return 0, ws.closedError()
 
 	case err = <-ws.errCh:
-		if debugVerbose {
-			println("Websocket: Write: Outstanding error", err.Error())
-		}
+		ws.logger.Warn("WebSocket: Write failed due to a previous error", "url", ws.URL, "err", err)
 		ws.ctxCancel()
 		return 0, fmt.Errorf("WebSocket: Previous write resulted in stream error; Details: %w", err)
 
@@ -221,29 +412,32 @@ func (ws *WebSocket) Write(buf []byte) (n int, err error) {
 
 	case <-ws.writeDeadlineTimer.C:
 		if remaining := ws.ws.Get("bufferedAmount").Int(); remaining > 0 {
+			ws.logger.Debug("WebSocket: Write deadline expired", "url", ws.URL, "bufferedAmount", remaining)
 			return 0, timeoutError{}
 		}
 
 	default:
+	}
+	//Send unless returned above, a deadline update must not drop the message
+	if typ == MessageText {
+		ws.ws.Call("send", string(buf))
+	} else {
 		jsBuf := uint8Array.New(len(buf))
 		js.CopyBytesToJS(jsBuf, buf)
 		ws.ws.Call("send", jsBuf)
-		if debugVerbose {
-			println("Websocket: Write", writeCount, "bytes", "(content: "+fmt.Sprintf("%q", buf)+")")
-		}
 	}
+	ws.counters.sent(writeCount, true)
 
 	//Check for status updates before returning
 	select {
 	case err = <-ws.errCh:
-		if debugVerbose {
-			println("Websocket: Write: outstanding error", err.Error())
-		}
+		ws.logger.Warn("WebSocket: Write failed", "url", ws.URL, "err", err)
 		ws.ctxCancel()
 		return 0, fmt.Errorf("WebSocket: Write resulted in stream error; Details: %w", err)
 
 	case <-ws.writeDeadlineTimer.C:
-		if reamining := ws.ws.Get("bufferedAmount").Int(); reamining > 0 {
+		if remaining := ws.ws.Get("bufferedAmount").Int(); remaining > 0 {
+			ws.logger.Debug("WebSocket: Write deadline expired", "url", ws.URL, "bufferedAmount", remaining)
 			return 0, timeoutError{}
 		}
 
@@ -252,6 +446,43 @@ func (ws *WebSocket) Write(buf []byte) (n int, err error) {
 	return writeCount, nil
 }
 
+//waitForDrain blocks while the browser's send queue (bufferedAmount) is above
+// the high-water mark until it drains below the low-water mark, there is no event
+// for this so it is polled; Only call from send!
+func (ws *WebSocket) waitForDrain() error {
+	buffered := ws.ws.Get("bufferedAmount").Int()
+	if ws.writeHighWater < 1 || buffered <= ws.writeHighWater {
+		return nil
+	}
+	ws.logger.Debug("WebSocket: Write waiting for the send queue to drain", "url", ws.URL, "bufferedAmount", buffered)
+
+	ticker := time.NewTicker(writeDrainPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ws.ctx.Done():
+			return ws.closedError()
+
+		case err := <-ws.errCh:
+			ws.logger.Warn("WebSocket: Write failed due to a previous error", "url", ws.URL, "err", err)
+			ws.ctxCancel()
+			return fmt.Errorf("WebSocket: Previous write resulted in stream error; Details: %w", err)
+
+		case newWriteDeadline := <-ws.newWriteDeadlineCh:
+			ws.setDeadline(ws.writeDeadlineTimer, newWriteDeadline)
+
+		case <-ws.writeDeadlineTimer.C:
+			ws.logger.Debug("WebSocket: Write deadline expired", "url", ws.URL, "bufferedAmount", ws.ws.Get("bufferedAmount").Int())
+			return timeoutError{}
+
+		case <-ticker.C:
+			if ws.ws.Get("bufferedAmount").Int() < ws.writeLowWater {
+				return nil
+			}
+		}
+	}
+}
+
 //Read implements the standard io.Reader interface (typical semantics)
 func (ws *WebSocket) Read(buf []byte) (int, error) {
 	//Check for noop
@@ -266,12 +497,9 @@ func (ws *WebSocket) Read(buf []byte) (int, error) {
 	//Check for close or new deadline
 	select {
 	case <-ws.ctx.Done():
-		return 0, ErrWebsocketClosed
+		return 0, ws.closedError()
 
 	case newReadDeadline := <-ws.newReadDeadlineCh:
-		if debugVerbose {
-			println("Websocket: Set new read deadline (pre-read)")
-		}
 		ws.setDeadline(ws.readDeadlineTimer, newReadDeadline)
 
 	default:
@@ -280,33 +508,14 @@ func (ws *WebSocket) Read(buf []byte) (int, error) {
 	for {
 		//Get next chunk
 		if ws.remaining == nil {
-			if debugVerbose {
-				println("Websocket: Read wait on queue-")
-			}
-			select {
-			case ws.remaining = <-ws.readCh:
-
-			case <-ws.ctx.Done():
-				return 0, ErrWebsocketClosed
-
-			case newReadDeadline := <-ws.newReadDeadlineCh:
-				if debugVerbose {
-					println("Websocket: Set new read deadline (during read)")
-				}
-				ws.setDeadline(ws.readDeadlineTimer, newReadDeadline)
-
-			case <-ws.readDeadlineTimer.C:
-				if debugVerbose {
-					println("Websocket: Read timeout")
-				}
-				return 0, timeoutError{}
+			msg, err := ws.nextMessage()
+			if err != nil {
+				return 0, err
 			}
+			ws.remaining, ws.remainingType = msg.rdr, msg.typ
 		}
 
 		//Read from chunk
-		if debugVerbose {
-			println("Websocket: Reading")
-		}
 		n, err := ws.remaining.Read(buf)
 		if err == io.EOF {
 			if closer, hasClose := ws.remaining.(io.Closer); hasClose {
@@ -317,13 +526,70 @@ func (ws *WebSocket) Read(buf []byte) (int, error) {
 				continue
 			}
 		}
-		if debugVerbose {
-			println("Websocket: Read", n, "bytes", "(content: "+fmt.Sprintf("%q", buf[:n])+")")
-		}
 		return n, err
 	}
 }
 
+//ReadMessage returns the type and content of the next websocket message, this
+// allows the websocket to be used as a message pipe rather than a byte stream.
+// If the current message was partially consumed by Read, its remainder is returned.
+// Read deadlines apply as they do to Read.
+func (ws *WebSocket) ReadMessage() (MessageType, []byte, error) {
+	//Lock
+	ws.readLock.Lock()
+	defer ws.readLock.Unlock()
+
+	//Check for close or new deadline
+	select {
+	case <-ws.ctx.Done():
+		return 0, nil, ws.closedError()
+
+	case newReadDeadline := <-ws.newReadDeadlineCh:
+		ws.setDeadline(ws.readDeadlineTimer, newReadDeadline)
+
+	default:
+	}
+
+	msg := jsMessage{typ: ws.remainingType, rdr: ws.remaining}
+	ws.remaining = nil
+	if msg.rdr == nil {
+		var err error
+		if msg, err = ws.nextMessage(); err != nil {
+			return 0, nil, err
+		}
+	}
+	if closer, hasClose := msg.rdr.(io.Closer); hasClose {
+		defer closer.Close()
+	}
+
+	buf, err := ioutil.ReadAll(msg.rdr)
+	if err != nil {
+		return 0, nil, err
+	}
+	return msg.typ, buf, nil
+}
+
+//nextMessage waits for the next message to be received; Only call from Read or ReadMessage!
+func (ws *WebSocket) nextMessage() (jsMessage, error) {
+	for {
+		select {
+		case msg := <-ws.readCh:
+			ws.counters.queued(-1)
+			return msg, nil
+
+		case <-ws.ctx.Done():
+			return jsMessage{}, ws.closedError()
+
+		case newReadDeadline := <-ws.newReadDeadlineCh:
+			ws.setDeadline(ws.readDeadlineTimer, newReadDeadline)
+
+		case <-ws.readDeadlineTimer.C:
+			ws.logger.Debug("WebSocket: Read deadline expired", "url", ws.URL)
+			return jsMessage{}, timeoutError{}
+		}
+	}
+}
+
 func (ws *WebSocket) SetDeadline(future time.Time) (err error) {
 	select {
 	case ws.newWriteDeadlineCh <- future:
@@ -336,18 +602,12 @@ func (ws *WebSocket) SetDeadline(future time.Time) (err error) {
 
 //SetWriteDeadline implements the Conn SetWriteDeadline method
 func (ws *WebSocket) SetWriteDeadline(future time.Time) error {
-	if debugVerbose {
-		println("Websocket: Set write deadline for", future.String())
-	}
 	ws.newWriteDeadlineCh <- future
 	return nil
 }
 
 //SetReadDeadline implements the Conn SetReadDeadline method
 func (ws *WebSocket) SetReadDeadline(future time.Time) error {
-	if debugVerbose {
-		println("Websocket: Set read deadline for", future.String())
-	}
 	ws.newReadDeadlineCh <- future
 	return nil
 }
@@ -383,17 +643,23 @@ func (ws *WebSocket) addHandler(handler func(this js.Value, args []js.Value), ev
 //handleOpen is a callback for JavaScript to notify Go when the websocket is open:
 // See: https://developer.mozilla.org/en-US/docs/Web/API/WebSocket/onopen
 func (ws *WebSocket) handleOpen(_ js.Value, _ []js.Value) {
-	if debugVerbose {
-		println("Websocket: Open JS callback!")
-	}
+	counters := newConnCounters()
+	counters.compressed = deflateNegotiated(ws.ws.Get("extensions").String())
+	ws.counters = counters
 	close(ws.openCh)
 }
 
 //handleClose is a callback for JavaScript to notify Go when the websocket is closed:
 // See: https://developer.mozilla.org/en-US/docs/Web/API/WebSocket/onclose
-func (ws *WebSocket) handleClose(_ js.Value, _ []js.Value) {
-	if debugVerbose {
-		println("Websocket: Close JS callback!")
+func (ws *WebSocket) handleClose(_ js.Value, args []js.Value) {
+	if len(args) > 0 && ws.ctx.Err() == nil {
+		event := args[0]
+		ws.closeErr = &CloseError{
+			Code:     event.Get("code").Int(),
+			Reason:   event.Get("reason").String(),
+			WasClean: event.Get("wasClean").Bool(),
+		}
+		ws.logger.Info("WebSocket: Closed remotely", "url", ws.URL, "code", ws.closeErr.Code, "reason", ws.closeErr.Reason, "wasClean", ws.closeErr.WasClean)
 	}
 	ws.ctxCancel()
 }
@@ -401,16 +667,11 @@ func (ws *WebSocket) handleClose(_ js.Value, _ []js.Value) {
 //handleError is a callback for JavaScript to notify Go when the websocket is in an error state:
 // See: https://developer.mozilla.org/en-US/docs/Web/API/WebSocket/onerror
 func (ws *WebSocket) handleError(_ js.Value, args []js.Value) {
-	if debugVerbose {
-		println("Websocket: Error JS Callback")
-	}
-	errMsg := "Unknown error"
-	if len(args) > 0 {
-		errMsg = args[0].String()
-	}
-
+	//The error event carries no details (by design, for security reasons), those
+	// are available from the close event that follows; See: CloseError
+	ws.logger.Warn("WebSocket: Browser reported an error", "url", ws.URL)
 	select {
-	case ws.errCh <- errors.New(errMsg):
+	case ws.errCh <- fmt.Errorf("WebSocket: Browser reported an error for %q; Details: See the browser console", ws.URL):
 	default:
 	}
 }
@@ -418,34 +679,57 @@ func (ws *WebSocket) handleError(_ js.Value, args []js.Value) {
 //handleMessage is a callback for JavaScript to notify Go when the websocket has a new message:
 // See: https://developer.mozilla.org/en-US/docs/Web/API/WebSocket/onmessage
 func (ws *WebSocket) handleMessage(_ js.Value, args []js.Value) {
-	if debugVerbose {
-		println("Websocket: New Message JS Callback")
-	}
-
 	select {
 	case <-ws.ctx.Done():
+		return
 	default:
 	}
 
+	//Text messages are always strings regardless of the binary type, they were
+	// validated to be UTF-8 by the browser which fails the websocket otherwise
+	if data := args[0].Get("data"); data.Type() == js.TypeString {
+		//The UTF-16 length is a lower bound of the UTF-8 length, check it before copying
+		if ws.exceedsReadLimit(data.Get("length").Int()) {
+			return
+		}
+		text := []byte(data.String())
+		if ws.exceedsReadLimit(len(text)) {
+			return
+		}
+		ws.counters.received(len(text), true)
+		ws.enqueueMessage(jsMessage{typ: MessageText, rdr: bytes.NewReader(text)})
+		return
+	}
+
 	var rdr io.Reader
 	var size int
 
 	switch ws.wsType {
 	case socketTypeArrayBuffer:
+		if ws.exceedsReadLimit(args[0].Get("data").Get("byteLength").Int()) {
+			return
+		}
 		rdr, size = newReaderArrayBuffer(args[0].Get("data"))
+		atomic.AddInt64(&ws.counters.arrayBufferReads, 1)
 		//Should we switch to blobs for next time?
-		if ws.enableBlob && size > socketStreamThresholdBytes {
+		if ws.enableBlob && size > ws.streamThreshold {
 			ws.wsType = socketTypeBlob
 			ws.wsType.Set(ws.ws)
+			ws.logger.Debug("WebSocket: Switched receive mode", "url", ws.URL, "mode", ws.wsType.String(), "messageSize", size)
 		}
 
 	case socketTypeBlob:
 		jsBlob := args[0].Get("data")
-		if size = jsBlob.Get("size").Int(); size <= socketStreamThresholdBytes {
+		if size = jsBlob.Get("size").Int(); ws.exceedsReadLimit(size) {
+			return
+		}
+		atomic.AddInt64(&ws.counters.blobReads, 1)
+		if size <= ws.streamThreshold {
 			rdr = newReaderArrayPromise(jsBlob.Call("arrayBuffer"))
 			//switch to ArrayBuffers for next read
 			ws.wsType = socketTypeArrayBuffer
 			ws.wsType.Set(ws.ws)
+			ws.logger.Debug("WebSocket: Switched receive mode", "url", ws.URL, "mode", ws.wsType.String(), "messageSize", size)
 		} else {
 			rdr = newStreamReaderPromise(jsBlob.Call("stream").Call("getReader"))
 		}
@@ -454,21 +738,40 @@ func (ws *WebSocket) handleMessage(_ js.Value, args []js.Value) {
 		panic(fmt.Sprintf("WebSocket: Unknown socket type: %s (%d)", ws.wsType, ws.wsType))
 	}
 
+	ws.counters.received(size, true)
+	ws.enqueueMessage(jsMessage{typ: MessageBinary, rdr: rdr})
+}
+
+//exceedsReadLimit returns true if a received message of the provided size
+// exceeds the read limit, in which case the websocket is closed; Only call from
+// handleMessage!
+func (ws *WebSocket) exceedsReadLimit(size int) bool {
+	limit := atomic.LoadInt64(&ws.readLimit)
+	if limit <= 0 || int64(size) <= limit {
+		return false
+	}
+
+	ws.failErr = fmt.Errorf("WebSocket: Received a %d byte message, the limit is %d bytes; Details: %w", size, limit, ErrMessageTooBig)
+	ws.logger.Warn("WebSocket: Closing after receiving a message that is too big", "url", ws.URL, "messageSize", size, "readLimit", limit)
+	ws.ws.Call("close", closeMessageTooBig, "Message too big")
+	ws.ctxCancel()
+	return true
+}
+
+//enqueueMessage queues a received message for Read, it never blocks; Only call
+// from handleMessage!
+func (ws *WebSocket) enqueueMessage(msg jsMessage) {
+	ws.counters.queued(1)
 	select {
-	case ws.readCh <- rdr: //Try non-blocking queue first...
-		if debugVerbose {
-			println("Websocket: JS read callback sync enqueue")
-		}
+	case ws.readCh <- msg: //Try non-blocking queue first...
 
 	case <-ws.ctx.Done():
 
 	default:
+		ws.logger.Debug("WebSocket: Read queue is full, queuing message asynchronously", "url", ws.URL, "readQueueDepth", cap(ws.readCh))
 		go func() { //Don't block in a callback!
 			select {
-			case ws.readCh <- rdr:
-				if debugVerbose {
-					println("Websocket: JS read callback async enqueue")
-				}
+			case ws.readCh <- msg:
 
 			case <-ws.ctx.Done():
 			}
@@ -3,9 +3,11 @@ package wasmws
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"net"
 	"strings"
+	"syscall/js"
 	"testing"
 	"time"
 )
@@ -54,6 +56,90 @@ func TestWebsocketEchoLarge(t *testing.T) {
 	}
 }
 
+func TestWebsocketCloseError(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	ws, err := New(testCtx, echoServiceWebSockURL)
+	if err != nil {
+		t.Fatalf("Could not construct test websocket against %q; Details: %s", echoServiceWebSockURL, err)
+	}
+	defer ws.Close()
+
+	//Deliver the close event the browser fires when the remote side closes
+	event := js.Global().Get("CloseEvent").New("close", map[string]interface{}{"code": 4000, "reason": "test reason", "wasClean": true})
+	ws.ws.Call("dispatchEvent", event)
+
+	_, readErr := ws.Read(make([]byte, 1))
+	_, writeErr := ws.Write([]byte("closed"))
+	for op, err := range map[string]error{"Read": readErr, "Write": writeErr} {
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) {
+			t.Fatalf("%s of a remotely closed websocket should return a *CloseError, not: %v", op, err)
+		}
+		if closeErr.Code != 4000 || closeErr.Reason != "test reason" || !closeErr.WasClean {
+			t.Fatalf("%s returned %+v rather than the close event's code and reason", op, *closeErr)
+		}
+		if !errors.Is(err, ErrWebsocketClosed) {
+			t.Fatalf("%s error %v does not match ErrWebsocketClosed", op, err)
+		}
+	}
+}
+
+func TestWebsocketWriteBackpressure(t *testing.T) {
+	const (
+		testTO   = time.Second * 10
+		deadline = time.Millisecond * 200
+	)
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	dialer := Dialer{WriteHighWaterMark: 1024, WriteLowWaterMark: 512}
+	conn, err := dialer.DialContext(testCtx, "websocket", echoServiceWebSockURL)
+	if err != nil {
+		t.Fatalf("Could not dial test websocket at %q; Details: %s", echoServiceWebSockURL, err)
+	}
+	defer conn.Close()
+	ws := conn.(*WebSocket)
+
+	//Simulate a browser send queue above the high-water mark
+	js.Global().Get("Object").Call("defineProperty", ws.ws, "bufferedAmount", map[string]interface{}{"value": 4096, "writable": true, "configurable": true})
+
+	//Blocked writes fail once the write deadline passes
+	ws.SetWriteDeadline(time.Now().Add(deadline))
+	start := time.Now()
+	_, err = ws.Write([]byte("blocked"))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("Write above the high-water mark should have timed out, not: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < deadline/2 {
+		t.Fatalf("Write above the high-water mark returned after %s, before its deadline", elapsed)
+	}
+
+	//Blocked writes resume once the queue drains below the low-water mark
+	ws.SetWriteDeadline(time.Time{})
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := ws.Write([]byte("resumed"))
+		errCh <- err
+	}()
+	select {
+	case err = <-errCh:
+		t.Fatalf("Write above the high-water mark did not block; Details: %v", err)
+	case <-time.After(deadline):
+	}
+	ws.ws.Set("bufferedAmount", 256)
+	select {
+	case err = <-errCh:
+		if err != nil {
+			t.Fatalf("Write failed after the send queue drained; Details: %s", err)
+		}
+	case <-testCtx.Done():
+		t.Fatalf("Write was still blocked after the send queue drained")
+	}
+}
+
 func echo(t testing.TB, in io.Reader, conn net.Conn, verify bool, optCopyBuf []byte, optReadBuf *bytes.Buffer) (copyBuf []byte, readBuf *bytes.Buffer) {
 	//Buffer setup
 	if optCopyBuf == nil {
@@ -0,0 +1,147 @@
+// +build !js,!wasm
+
+package wasmws
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+//WebSockConn is the net.Conn implementation provided by WebSockListener.Accept,
+// it is an incoming websocket connection
+type WebSockConn struct {
+	ws     *websocket.Conn
+	stream *wsStream
+
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	req        *http.Request
+	identity   interface{}
+}
+
+var _ net.Conn = (*WebSockConn)(nil)
+
+//newWebSockConn wraps an accepted websocket and its stream adapter, a copy of
+// the upgrade request is retained for later inspection
+func newWebSockConn(ws *websocket.Conn, stream *wsStream, localAddr, remoteAddr net.Addr, req *http.Request, identity interface{}) *WebSockConn {
+	req = req.Clone(context.Background())
+	req.Body = http.NoBody
+
+	return &WebSockConn{
+		ws:         ws,
+		stream:     stream,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+		req:        req,
+		identity:   identity,
+	}
+}
+
+//Request returns the HTTP request that was upgraded to this websocket. This
+// provides access to the headers, cookies, URL (and query), TLS state and any
+// other metadata of the request; The body is always empty.
+func (conn *WebSockConn) Request() *http.Request {
+	return conn.req
+}
+
+//Identity returns the identity the listener's Authenticator attached to this
+// connection, nil if there is none
+func (conn *WebSockConn) Identity() interface{} {
+	return conn.identity
+}
+
+//UpgradeRequest returns the HTTP upgrade request of a connection that was
+// accepted from a WebSockListener. Connections wrapping the accepted connection,
+// such as *tls.Conn, are unwrapped if they provide a NetConn method.
+func UpgradeRequest(conn net.Conn) (*http.Request, bool) {
+	wsConn, ok := unwrapWebSockConn(conn)
+	if !ok {
+		return nil, false
+	}
+	return wsConn.Request(), true
+}
+
+//unwrapWebSockConn returns the WebSockConn the provided connection is or wraps
+func unwrapWebSockConn(conn net.Conn) (*WebSockConn, bool) {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *WebSockConn:
+			return c, true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+//Read implements the standard io.Reader interface, message boundaries are not
+// preserved; See: ReadMessage
+func (conn *WebSockConn) Read(buf []byte) (int, error) {
+	return conn.stream.Read(buf)
+}
+
+//Write implements the standard io.Writer interface, each write is sent as a
+// single websocket message
+func (conn *WebSockConn) Write(buf []byte) (int, error) {
+	return conn.stream.Write(buf)
+}
+
+//ReadMessage returns the type and content of the next websocket message, this
+// allows the connection to be used as a message pipe rather than a byte stream.
+// If the current message was partially consumed by Read, its remainder is returned.
+// The whole message is buffered in memory, up to ListenerOptions.ReadLimit.
+// Read deadlines apply.
+func (conn *WebSockConn) ReadMessage() (MessageType, []byte, error) {
+	return conn.stream.ReadMessage()
+}
+
+//WriteMessage sends the provided data as a single websocket message of the
+// provided type. Write deadlines apply.
+func (conn *WebSockConn) WriteMessage(typ MessageType, msg []byte) error {
+	return conn.stream.WriteMessage(typ, msg)
+}
+
+//Close closes the websocket with a normal closure status, it waits for the
+// closing handshake (up to 5 seconds if the client is not reading)
+func (conn *WebSockConn) Close() error {
+	return conn.stream.Close()
+}
+
+//Stats returns the statistics of the connection
+func (conn *WebSockConn) Stats() ConnStats {
+	return conn.stream.Stats()
+}
+
+//LocalAddr returns the websocket URL the connection was accepted on
+func (conn *WebSockConn) LocalAddr() net.Addr {
+	return conn.localAddr
+}
+
+//RemoteAddr returns the address of the client, this is a *net.TCPAddr unless
+// the client address could not be parsed. If the listener trusts the proxy the
+// connection was received from, the forwarded client address is used; See:
+// ListenerOptions.TrustedProxies
+func (conn *WebSockConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+//SetDeadline implements the Conn SetDeadline method
+func (conn *WebSockConn) SetDeadline(future time.Time) error {
+	return conn.stream.SetDeadline(future)
+}
+
+//SetReadDeadline implements the Conn SetReadDeadline method
+func (conn *WebSockConn) SetReadDeadline(future time.Time) error {
+	return conn.stream.SetReadDeadline(future)
+}
+
+//SetWriteDeadline implements the Conn SetWriteDeadline method
+func (conn *WebSockConn) SetWriteDeadline(future time.Time) error {
+	return conn.stream.SetWriteDeadline(future)
+}
@@ -5,20 +5,191 @@ package wasmws
 import (
 	"context"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"nhooyr.io/websocket"
 )
 
+const (
+	defaultAcceptQueueSize  = 8                     //The default of ListenerOptions.AcceptQueueSize
+	defaultReadLimit        = 32 * 1024 * 1024      //The default of ListenerOptions.ReadLimit
+	defaultShutdownIdleTime = time.Second * 5       //The default of ListenerOptions.ShutdownIdleTime
+	shutdownPollInterval    = time.Millisecond * 50 //How often Shutdown checks for idle connections
+)
+
+//errListenerClosed is returned by Accept once the listener is closed and
+// reported for requests received after, errors.Is(err, net.ErrClosed) is true so
+// servers like grpc.Server and http.Server stop serving cleanly.
+var errListenerClosed = fmt.Errorf("WebSockListener: Listener is closed; Details: %w", net.ErrClosed)
+
 //WebSockListener implements net.Listener and provides connections that are
 //incoming websocket connections
 type WebSockListener struct {
-	ctx       context.Context
+	//64-bit values accessed atomically come first to guarantee their alignment
+	accepted, rejected, active int64
+
+	ctx       context.Context //Lifetime of the listener
 	ctxCancel context.CancelFunc
 
-	acceptCh chan net.Conn
+	connCtx    context.Context //Lifetime of the connections, which outlive the listener
+	connCancel context.CancelFunc
+	connLock   sync.Mutex
+	conns      map[*wsStream]bool //Open websockets, true once told to go away
+
+	opts          ListenerOptions
+	logger        Logger
+	metrics       MetricsCollector
+	acceptOptions *websocket.AcceptOptions
+	acceptCh      chan *queuedConn
+	addr          atomic.Value     //wsAddr of the first request served
+	sessions      *sessionRegistry //Only set if resumable sessions are enabled
+
+	failureLock sync.Mutex
+	failures    map[string]int64 //Count of requests not accepted by reason
+}
+
+//ListenerOptions are the options used to upgrade every inbound HTTP request
+// accepted by a WebSockListener, the zero value is the same as the defaults of
+// nhooyr.io/websocket: Only same origin clients are accepted, no subprotocol is
+// negotiated and compression is disabled.
+type ListenerOptions struct {
+	//OriginPatterns lists host patterns (see: path/filepath.Match) of authorized
+	// cross origin clients, ex. "*.example.com"; The request host is always
+	// authorized. This is needed if the web application making the websocket
+	// connection is served from a different origin, such as a CDN.
+	OriginPatterns []string
+
+	//InsecureSkipVerify disables origin verification entirely, you probably
+	// want OriginPatterns instead (see: websocket.AcceptOptions for the risks)
+	InsecureSkipVerify bool
+
+	//Subprotocols lists the subprotocols the listener supports in order of
+	// preference, the first one also offered by a client is selected.
+	Subprotocols []string
+
+	//CompressionMode controls negotiation of the permessage-deflate extension,
+	// which browsers always offer, it defaults to websocket.CompressionDisabled.
+	// websocket.CompressionContextTakeover compresses best by reusing the
+	// compression window across messages at the cost of memory per connection,
+	// websocket.CompressionNoContextTakeover compresses each message separately.
+	// Whether compression was negotiated is reported by WebSockConn.Stats.
+	CompressionMode websocket.CompressionMode
+
+	//CompressionThreshold is the minimum size in bytes of sent messages that are
+	// compressed, it defaults to 128 with context takeover and 512 without.
+	CompressionThreshold int
+
+	//MessageType is the type of the websocket messages used by the Read and
+	// Write methods of accepted connections, it defaults to MessageBinary. Use
+	// MessageText to interoperate with peers that only exchange text messages,
+	// such as JSON-over-WebSocket services; Each Write must then be valid UTF-8.
+	MessageType MessageType
+
+	//ReadLimit is the maximum size in bytes of a single inbound websocket
+	// message, it defaults to 32 MiB and if negative no limit is enforced (then
+	// a client can exhaust the server's memory with ReadMessage, which buffers
+	// whole messages). A connection receiving a larger message is closed with
+	// the "message too big" close code (1009) and reads return an error matching
+	// ErrMessageTooBig.
+	ReadLimit int64
+
+	//TrustedProxies are the networks of reverse proxies (ex. load balancers or
+	// CDN edges) whose Forwarded or X-Forwarded-For headers are believed when
+	// determining the RemoteAddr of accepted connections. If empty, forwarding
+	// headers are ignored and the address of the HTTP peer is used.
+	TrustedProxies []*net.IPNet
+
+	//Authenticate, if set, is called before upgrading each request and can
+	// reject it or attach an identity to the connection; See: Authenticator
+	Authenticate Authenticator
+
+	//AcceptQueueSize is the number of upgraded websockets that may wait for
+	// Accept to be called before further upgrades wait as well, it defaults to 8.
+	AcceptQueueSize int
+
+	//AcceptTimeout, if set, is the longest an upgraded websocket waits to be
+	// accepted, whether for room in the accept queue or in it; If exceeded the
+	// websocket is closed with the "try again later" close code (1013) so a slow
+	// server does not accumulate pending websockets.
+	AcceptTimeout time.Duration
+
+	//MaxConnections, if set, limits the number of open websockets, requests
+	// beyond the limit are refused with 503 (Service Unavailable) before being
+	// upgraded.
+	MaxConnections int
+
+	//PingInterval, if set, is how often accepted websockets are pinged to keep
+	// them alive through intermediaries (ex. CDNs and load balancers) that drop
+	// idle connections and to detect unresponsive clients. Pinging (and the
+	// IdleTimeout) starts once a websocket is returned by Accept.
+	PingInterval time.Duration
+
+	//PongTimeout is how long to wait for a ping to be answered before closing
+	// the websocket, it defaults to PingInterval. Pongs are only received while
+	// the connection is being read, as servers such as grpc.Server always do.
+	PongTimeout time.Duration
+
+	//IdleTimeout, if set, closes accepted websockets with a going away status
+	// (1001) once no messages have been sent or received for this long; Pings
+	// are not considered traffic.
+	IdleTimeout time.Duration
+
+	//ShutdownIdleTime is how long a websocket must go without sending or
+	// receiving a message for Shutdown to consider it idle and close it, it
+	// defaults to 5 seconds. Raise it if requests may be quiet for longer, such
+	// as a gRPC call whose handler takes a while to reply.
+	ShutdownIdleTime time.Duration
+
+	//Resume, if set, enables resumable sessions: Accept returns connections that
+	// survive their websocket being lost if the client reconnects in time. All
+	// clients must then connect using DialResumable. A session can only be
+	// resumed by a request with the same identity (compared by reflect.DeepEqual)
+	// as the one that started it; See: Authenticate
+	Resume *ResumeOptions
+
+	//Logger, if set, receives diagnostic events of the listener such as rejected
+	// and failed websocket upgrades. Otherwise warnings and errors are written
+	// using the standard log package.
+	Logger Logger
+
+	//Metrics, if set, receives the events needed to maintain metrics of the
+	// listener; See: ExpvarMetrics and PrometheusMetrics
+	Metrics MetricsCollector
+
+	//OnAcceptError, if set, is called with the reason for every request that
+	// does not result in an accepted connection. It is called by ServeHTTP and
+	// must not block; To receive the errors on a channel, send to a buffered
+	// channel without blocking.
+	OnAcceptError func(*AcceptError)
+}
+
+//AcceptError describes an HTTP request that did not result in an accepted
+// websocket connection; See: ListenerOptions.OnAcceptError
+type AcceptError struct {
+	Reason     string        //Reason is one of the Failure... constants
+	RemoteAddr net.Addr      //RemoteAddr is the address of the client
+	Request    *http.Request //Request is the HTTP request that was not accepted
+	Err        error         //Err is the cause
+}
+
+func (ae *AcceptError) Error() string {
+	return fmt.Sprintf("WebSockListener: Could not accept websocket from %s (%s); Details: %s", ae.RemoteAddr, ae.Reason, ae.Err)
+}
+
+//Unwrap returns the cause of the error
+func (ae *AcceptError) Unwrap() error {
+	return ae.Err
+}
+
+//ListenerStats are the aggregate statistics of a WebSockListener
+type ListenerStats struct {
+	Accepted int64 //Accepted is the number of websockets returned by Accept or that resumed a session
+	Rejected int64 //Rejected is the number of requests refused or that failed to upgrade or be accepted
+	Active   int64 //Active is the number of upgraded websockets that are still open
 }
 
 var (
@@ -27,20 +198,58 @@ var (
 )
 
 //NewWebSocketListener constructs a new WebSockListener, the provided context
-//is for the lifetime of the listener.
+//is for the lifetime of the listener (not the connections it has accepted).
 func NewWebSocketListener(ctx context.Context) *WebSockListener {
+	return NewWebSocketListenerWithOptions(ctx, ListenerOptions{})
+}
+
+//NewWebSocketListenerWithOptions constructs a new WebSockListener that applies
+// the provided options to every websocket upgrade, the provided context is for
+// the lifetime of the listener (not the connections it has accepted).
+func NewWebSocketListenerWithOptions(ctx context.Context, opts ListenerOptions) *WebSockListener {
 	ctx, cancel := context.WithCancel(ctx)
+	connCtx, connCancel := context.WithCancel(context.Background())
 	wsl := &WebSockListener{
-		ctx:       ctx,
-		ctxCancel: cancel,
-		acceptCh:  make(chan net.Conn, 8),
+		ctx:        ctx,
+		ctxCancel:  cancel,
+		connCtx:    connCtx,
+		connCancel: connCancel,
+		conns:      make(map[*wsStream]bool),
+		failures:   make(map[string]int64),
+		opts:       opts,
+		logger:     opts.Logger,
+		metrics:    opts.Metrics,
+		acceptOptions: &websocket.AcceptOptions{
+			OriginPatterns:       opts.OriginPatterns,
+			InsecureSkipVerify:   opts.InsecureSkipVerify,
+			Subprotocols:         opts.Subprotocols,
+			CompressionMode:      opts.CompressionMode,
+			CompressionThreshold: opts.CompressionThreshold,
+		},
+	}
+	if opts.AcceptQueueSize > 0 {
+		wsl.acceptCh = make(chan *queuedConn, opts.AcceptQueueSize)
+	} else {
+		wsl.acceptCh = make(chan *queuedConn, defaultAcceptQueueSize)
 	}
+	if wsl.logger == nil {
+		wsl.logger = stdLogger{}
+	}
+	if wsl.metrics == nil {
+		wsl.metrics = nopMetrics{}
+	}
+	if opts.Resume != nil {
+		wsl.sessions = newSessionRegistry(opts.Resume)
+	}
+
 	go func() { //Close queued connections
 		<-ctx.Done()
 		for {
 			select {
-			case conn := <-wsl.acceptCh:
-				conn.Close()
+			case queued := <-wsl.acceptCh:
+				if queued.claim(queuedExpired) {
+					queued.conn.Close()
+				}
 				continue
 			default:
 			}
@@ -53,53 +262,314 @@ func NewWebSocketListener(ctx context.Context) *WebSockListener {
 //ServeHTTP is a method that is mean to be used as http.HandlerFunc to accept inbound HTTP requests
 // that are websocket connections
 func (wsl *WebSockListener) ServeHTTP(wtr http.ResponseWriter, req *http.Request) {
+	wsl.metrics.UpgradeAttempted()
+	clientAddr := remoteAddr(req, wsl.opts.TrustedProxies)
 	select {
 	case <-wsl.ctx.Done():
+		wsl.reject(req, clientAddr, FailureShutdown, errListenerClosed)
 		http.Error(wtr, "503: Service is shutdown", http.StatusServiceUnavailable)
-		log.Printf("WebSockListener: WARN: A websocket listener's HTTP Accept was called when shutdown!")
+		wsl.logger.Warn("WebSockListener: HTTP Accept was called when shutdown", "remoteAddr", clientAddr.String())
 		return
 	default:
 	}
 
-	ws, err := websocket.Accept(wtr, req, nil)
+	identity, err := authenticate(wsl.opts.Authenticate, wtr, req)
+	if err != nil {
+		wsl.reject(req, clientAddr, FailureUnauthorized, err)
+		wsl.logger.Warn("WebSockListener: Rejected websocket", "remoteAddr", clientAddr.String(), "err", err)
+		return
+	}
+
+	//Reserve the connection before upgrading so the limit is never exceeded
+	if active := atomic.AddInt64(&wsl.active, 1); wsl.opts.MaxConnections > 0 && active > int64(wsl.opts.MaxConnections) {
+		atomic.AddInt64(&wsl.active, -1)
+		wsl.reject(req, clientAddr, FailureOverloaded, fmt.Errorf("Connection limit of %d reached", wsl.opts.MaxConnections))
+		http.Error(wtr, "503: Too many connections", http.StatusServiceUnavailable)
+		wsl.logger.Warn("WebSockListener: Refused websocket, connection limit reached", "remoteAddr", clientAddr.String(), "limit", wsl.opts.MaxConnections)
+		return
+	}
+
+	ws, err := websocket.Accept(wtr, req, wsl.acceptOptions)
 	if err != nil {
-		log.Printf("WebSockListener: ERROR: Could not accept websocket from %q; Details: %s", req.RemoteAddr, err)
+		atomic.AddInt64(&wsl.active, -1)
+		wsl.reject(req, clientAddr, FailureUpgrade, err)
+		wsl.logger.Error("WebSockListener: Could not accept websocket", "remoteAddr", clientAddr.String(), "err", err)
+		return
+	}
+
+	stream := newWSStream(wsl.connCtx, ws, wsl.streamType())
+	stream.counters.compressed = deflateNegotiated(wtr.Header().Get("Sec-WebSocket-Extensions"))
+	readLimit := wsl.opts.ReadLimit
+	if readLimit == 0 {
+		readLimit = defaultReadLimit
+	}
+	stream.setReadLimit(readLimit)
+	stream.metrics = wsl.metrics
+	wsl.connLock.Lock()
+	wsl.conns[stream] = false
+	wsl.connLock.Unlock()
+	stream.onClose = func() {
+		wsl.connLock.Lock()
+		delete(wsl.conns, stream)
+		wsl.connLock.Unlock()
+		atomic.AddInt64(&wsl.active, -1)
+		wsl.metrics.ConnectionClosed(time.Since(stream.counters.connectedAt))
+	}
+	wsl.metrics.ConnectionOpened()
+
+	localAddr := requestAddr(req)
+	if wsl.addr.Load() == nil {
+		wsl.addr.Store(localAddr)
+	}
+	wsl.logger.Debug("WebSockListener: Upgraded websocket", "remoteAddr", clientAddr.String(), "url", localAddr.String(), "protocol", ws.Subprotocol())
+	var conn net.Conn = newWebSockConn(ws, stream, localAddr, clientAddr, req, identity)
+	var session *resumableConn
+	if wsl.sessions != nil {
+		if session, err = wsl.sessions.serve(conn, identity); err != nil {
+			wsl.reject(req, clientAddr, FailureSession, err)
+			stream.closed()
+			wsl.logger.Error("WebSockListener: Could not start or resume session", "remoteAddr", clientAddr.String(), "err", err)
+			return
+		}
+		if session == nil { //An existing session was resumed, it has already been accepted
+			atomic.AddInt64(&wsl.accepted, 1)
+			wsl.startKeepAlive(stream, clientAddr)
+			wsl.logger.Debug("WebSockListener: Resumed session", "remoteAddr", clientAddr.String())
+			return
+		}
+		conn = session
+	}
+
+	abandon := func(reason string, status websocket.StatusCode, err error) {
+		wsl.logger.Warn("WebSockListener: Connection was not accepted", "remoteAddr", clientAddr.String(), "err", err)
+		if session != nil {
+			session.Close()
+		}
+		wsl.reject(req, clientAddr, reason, err)
+		ws.Close(status, err.Error())
+		stream.closed()
+	}
+
+	//The accept timeout applies both while waiting to be queued and once queued
+	queued := &queuedConn{conn: conn, stream: stream, clientAddr: clientAddr}
+	var expired chan struct{}
+	if wsl.opts.AcceptTimeout > 0 {
+		expired = make(chan struct{})
+		queued.expiry = time.AfterFunc(wsl.opts.AcceptTimeout, func() {
+			if queued.claim(queuedExpired) {
+				close(expired)
+				abandon(FailureAcceptTimeout, websocket.StatusTryAgainLater, fmt.Errorf("Failed to accept connection within %s; Try again later", wsl.opts.AcceptTimeout))
+			}
+		})
 	}
 
-	conn := websocket.NetConn(wsl.ctx, ws, websocket.MessageBinary)
 	select {
-	case wsl.acceptCh <- conn:
+	case wsl.acceptCh <- queued:
+		wsl.metrics.AcceptQueueDepth(len(wsl.acceptCh))
+		return
+	case <-expired:
+		return
 	case <-wsl.ctx.Done():
-		ws.Close(websocket.StatusBadGateway, fmt.Sprintf("Failed to accept connection before websocket listener shutdown; Details: %s", wsl.ctx.Err()))
+		err = fmt.Errorf("Failed to accept connection before websocket listener shutdown; Details: %s", wsl.ctx.Err())
 	case <-req.Context().Done():
-		ws.Close(websocket.StatusBadGateway, fmt.Sprintf("Failed to accept connection before websocket HTTP request cancelation; Details: %s", req.Context().Err()))
+		err = fmt.Errorf("Failed to accept connection before websocket HTTP request cancelation; Details: %s", req.Context().Err())
+	}
+	if queued.claim(queuedExpired) {
+		queued.stopExpiry()
+		abandon(FailureNotAccepted, websocket.StatusBadGateway, err)
+	}
+}
+
+//queuedConn is a connection in the accept queue, which is owned by whichever of
+// Accept or the accept timeout claims it first
+type queuedConn struct {
+	conn       net.Conn
+	stream     *wsStream
+	clientAddr net.Addr
+	expiry     *time.Timer //Abandons the connection once AcceptTimeout elapses, if set
+	state      int32       //queuedWaiting until (atomically) claimed
+}
+
+const (
+	queuedWaiting int32 = iota
+	queuedAccepted
+	queuedExpired
+)
+
+//claim returns true if the caller now owns the connection, false if it was
+// already accepted or abandoned
+func (qc *queuedConn) claim(state int32) bool {
+	return atomic.CompareAndSwapInt32(&qc.state, queuedWaiting, state)
+}
+
+//stopExpiry stops the accept timeout of a claimed connection
+func (qc *queuedConn) stopExpiry() {
+	if qc.expiry != nil {
+		qc.expiry.Stop()
+	}
+}
+
+//reject records and reports a request that did not result in an accepted
+// connection
+func (wsl *WebSockListener) reject(req *http.Request, clientAddr net.Addr, reason string, err error) {
+	atomic.AddInt64(&wsl.rejected, 1)
+	wsl.failureLock.Lock()
+	wsl.failures[reason]++
+	wsl.failureLock.Unlock()
+	wsl.metrics.UpgradeFailed(reason)
+
+	if wsl.opts.OnAcceptError != nil {
+		wsl.opts.OnAcceptError(&AcceptError{Reason: reason, RemoteAddr: clientAddr, Request: req, Err: err})
+	}
+}
+
+//startKeepAlive starts pinging and enforcing the idle timeout of the provided
+// stream if enabled. This starts once the stream is accepted since pongs are only
+// received while it is being read.
+func (wsl *WebSockListener) startKeepAlive(stream *wsStream, clientAddr net.Addr) {
+	if wsl.opts.PingInterval > 0 || wsl.opts.IdleTimeout > 0 {
+		go wsl.keepAlive(stream, clientAddr)
+	}
+}
+
+//keepAlive pings and enforces the idle timeout of the provided stream until it
+// is closed
+func (wsl *WebSockListener) keepAlive(stream *wsStream, clientAddr net.Addr) {
+	pongTimeout := wsl.opts.PongTimeout
+	if pongTimeout <= 0 {
+		pongTimeout = wsl.opts.PingInterval
+	}
+	if err := stream.keepAlive(wsl.opts.PingInterval, pongTimeout, wsl.opts.IdleTimeout); err != nil {
+		wsl.logger.Info("WebSockListener: Closed inactive websocket", "remoteAddr", clientAddr.String(), "err", err)
+	}
+}
+
+//streamType returns the type of messages accepted connections read and write
+func (wsl *WebSockListener) streamType() MessageType {
+	if wsl.opts.MessageType == MessageText {
+		return MessageText
 	}
+	return MessageBinary
 }
 
 //Accept fulfills the net.Listener interface and returns net.Conn that are incoming
-// websockets
+// websockets, once the listener is closed it returns an error for which
+// errors.Is(err, net.ErrClosed) is true.
 func (wsl *WebSockListener) Accept() (net.Conn, error) {
-	select {
-	case conn := <-wsl.acceptCh:
-		return conn, nil
-	case <-wsl.ctx.Done():
-		return nil, fmt.Errorf("Listener closed; Details: %w", wsl.ctx.Err())
+	for {
+		select {
+		case queued := <-wsl.acceptCh:
+			wsl.metrics.AcceptQueueDepth(len(wsl.acceptCh))
+			if !queued.claim(queuedAccepted) { //Abandoned while queued
+				continue
+			}
+			queued.stopExpiry()
+			atomic.AddInt64(&wsl.accepted, 1)
+			wsl.startKeepAlive(queued.stream, queued.clientAddr)
+			return queued.conn, nil
+		case <-wsl.ctx.Done():
+			return nil, errListenerClosed
+		}
 	}
 }
 
-//Close closes the listener
+//Close closes the listener: New websockets are refused and those waiting to be
+// accepted are closed, connections that have already been accepted are not
+// affected; See: Shutdown. Since sessions can no longer be resumed, resumable
+// sessions end once they are (or if they already are) disconnected.
 func (wsl *WebSockListener) Close() error {
 	wsl.ctxCancel()
+	if wsl.sessions != nil {
+		wsl.sessions.close()
+	}
 	return nil
 }
 
-//RemoteAddr returns a dummy websocket address to satisfy net.Listener
-func (wsl *WebSockListener) Addr() net.Addr {
-	return wsAddr{}
+//Shutdown gracefully shuts down the listener, like http.Server.Shutdown: It
+// closes the listener, then closes each open websocket with a going away status
+// (1001) once it is idle (no message is being written and none has been sent or
+// received for ListenerOptions.ShutdownIdleTime) and waits for them all to close.
+// Resumable sessions are closed immediately as they could no longer be resumed.
+// If the provided context expires first, the remaining websockets are closed
+// abruptly and the context's error is returned.
+func (wsl *WebSockListener) Shutdown(ctx context.Context) error {
+	wsl.Close()
+	if wsl.sessions != nil {
+		wsl.sessions.closeAll()
+	}
+
+	idleTime := wsl.opts.ShutdownIdleTime
+	if idleTime <= 0 {
+		idleTime = defaultShutdownIdleTime
+	}
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if wsl.goAwayIdle(idleTime) {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			wsl.connCancel()
+			wsl.logger.Warn("WebSockListener: Shutdown closed active websockets", "err", ctx.Err())
+			return ctx.Err()
+		}
+	}
 }
 
-type wsAddr struct{}
+//goAwayIdle tells the websockets that have been idle for the provided duration
+// to go away and returns true if there are no websockets left open
+func (wsl *WebSockListener) goAwayIdle(idleTime time.Duration) bool {
+	wsl.connLock.Lock()
+	defer wsl.connLock.Unlock()
 
-func (wsAddr) Network() string { return "websocket" }
+	for stream, goingAway := range wsl.conns {
+		if !goingAway && stream.idle(idleTime) {
+			wsl.conns[stream] = true
+			stream.goAway("Server is shutting down")
+		}
+	}
+	return len(wsl.conns) == 0
+}
+
+//Stats returns the aggregate statistics of the listener
+func (wsl *WebSockListener) Stats() ListenerStats {
+	return ListenerStats{
+		Accepted: atomic.LoadInt64(&wsl.accepted),
+		Rejected: atomic.LoadInt64(&wsl.rejected),
+		Active:   atomic.LoadInt64(&wsl.active),
+	}
+}
+
+//Failures returns the number of requests that did not result in an accepted
+// connection by reason (the Failure... constants)
+func (wsl *WebSockListener) Failures() map[string]int64 {
+	wsl.failureLock.Lock()
+	defer wsl.failureLock.Unlock()
+
+	failures := make(map[string]int64, len(wsl.failures))
+	for reason, count := range wsl.failures {
+		failures[reason] = count
+	}
+	return failures
+}
 
-func (wsAddr) String() string { return "websocket" }
+//Addr returns the websocket URL the listener is serving, ex. "ws://host/path".
+// Since the listener is mounted by an HTTP server this is unknown until the first
+// request is served; Until then the placeholder address "websocket" is returned.
+func (wsl *WebSockListener) Addr() net.Addr {
+	if addr, ok := wsl.addr.Load().(wsAddr); ok {
+		return addr
+	}
+	return wsAddr("websocket")
+}
+
+//requestAddr returns the websocket URL of the provided HTTP request
+func requestAddr(req *http.Request) wsAddr {
+	scheme := "ws"
+	if req.TLS != nil {
+		scheme = "wss"
+	}
+	return wsAddr(scheme + "://" + req.Host + req.URL.Path)
+}
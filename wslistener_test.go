@@ -0,0 +1,1107 @@
+// +build !js,!wasm
+
+package wasmws
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	pb "google.golang.org/grpc/examples/helloworld/helloworld"
+	"google.golang.org/grpc/peer"
+	"nhooyr.io/websocket"
+)
+
+//These tests run natively against a WebSockListener served by an httptest.Server
+
+//newTestListener returns a WebSockListener with the provided options being
+// served by a test HTTP server and the websocket URL of that server
+func newTestListener(t testing.TB, opts ListenerOptions) (*WebSockListener, string) {
+	wsl := NewWebSocketListenerWithOptions(context.Background(), opts)
+	server := httptest.NewServer(wsl)
+	t.Cleanup(func() {
+		wsl.Close()
+		server.Close()
+	})
+	return wsl, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+//testLogger is a Logger that records the messages of events
+type testLogger struct {
+	sync.Mutex
+	events []string
+}
+
+func (tl *testLogger) log(level, msg string) {
+	tl.Lock()
+	defer tl.Unlock()
+	tl.events = append(tl.events, level+" "+msg)
+}
+
+func (tl *testLogger) Debug(msg string, _ ...interface{}) { tl.log("DEBUG", msg) }
+
+func (tl *testLogger) Info(msg string, _ ...interface{}) { tl.log("INFO", msg) }
+
+func (tl *testLogger) Warn(msg string, _ ...interface{}) { tl.log("WARN", msg) }
+
+func (tl *testLogger) Error(msg string, _ ...interface{}) { tl.log("ERROR", msg) }
+
+//count returns the number of recorded events with the provided level and message
+func (tl *testLogger) count(level, msg string) (count int) {
+	tl.Lock()
+	defer tl.Unlock()
+	for _, event := range tl.events {
+		if event == level+" "+msg {
+			count++
+		}
+	}
+	return count
+}
+
+func TestListenerAuthenticate(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	logger := new(testLogger)
+	wsl, wsURL := newTestListener(t, ListenerOptions{
+		Logger: logger,
+		Authenticate: func(req *http.Request) (interface{}, error) {
+			switch token := req.URL.Query().Get("token"); token {
+			case "":
+				return nil, NewAuthError(http.StatusUnauthorized, "missing token")
+			case "good":
+				return "test-user", nil
+			default:
+				return nil, NewAuthError(http.StatusForbidden, "bad token")
+			}
+		},
+	})
+
+	for query, expected := range map[string]int{"": http.StatusUnauthorized, "?token=bad": http.StatusForbidden} {
+		_, resp, err := websocket.Dial(testCtx, wsURL+query, nil)
+		if err == nil {
+			t.Fatalf("Dial with query %q should have been rejected", query)
+		}
+		if resp == nil || resp.StatusCode != expected {
+			t.Fatalf("Dial with query %q should have been rejected with status %d; Response: %+v", query, expected, resp)
+		}
+	}
+
+	ws, _, err := websocket.Dial(testCtx, wsURL+"?token=good", nil)
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	conn, err := wsl.Accept()
+	if err != nil {
+		t.Fatalf("Could not accept test connection; Details: %s", err)
+	}
+	defer conn.Close()
+	defer ws.CloseNow()
+
+	if identity := conn.(*WebSockConn).Identity(); identity != "test-user" {
+		t.Fatalf("Accepted connection's identity was %v rather than %q", identity, "test-user")
+	}
+	if req, ok := UpgradeRequest(conn); !ok || req.URL.Query().Get("token") != "good" {
+		t.Fatalf("Accepted connection's upgrade request was not available")
+	}
+	if rejected := logger.count("WARN", "WebSockListener: Rejected websocket"); rejected != 2 {
+		t.Fatalf("Logger received %d rather than 2 rejection events; Events: %q", rejected, logger.events)
+	}
+	if upgraded := logger.count("DEBUG", "WebSockListener: Upgraded websocket"); upgraded != 1 {
+		t.Fatalf("Logger received %d rather than 1 upgrade events; Events: %q", upgraded, logger.events)
+	}
+}
+
+func TestListenerAcceptErrors(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	errCh := make(chan *AcceptError, 8)
+	wsl, wsURL := newTestListener(t, ListenerOptions{
+		Logger:        nopLogger{},
+		OnAcceptError: func(err *AcceptError) { errCh <- err },
+		Authenticate: func(req *http.Request) (interface{}, error) {
+			if req.URL.Query().Get("deny") != "" {
+				return nil, NewAuthError(http.StatusForbidden, "denied")
+			}
+			return nil, nil
+		},
+	})
+	expectErr := func(reason string) *AcceptError {
+		select {
+		case err := <-errCh:
+			if err.Reason != reason || err.Request == nil || err.RemoteAddr == nil || err.Err == nil {
+				t.Fatalf("Accept error should have been a complete %q error, not: %#v", reason, err)
+			}
+			return err
+		case <-testCtx.Done():
+			t.Fatalf("Accept error %q was not reported", reason)
+			return nil
+		}
+	}
+
+	if _, err := DialContext(testCtx, "websocket", wsURL+"?deny=1"); err == nil {
+		t.Fatalf("Dial should have been rejected")
+	}
+	var authErr *AuthError
+	if err := expectErr(FailureUnauthorized); !errors.As(err, &authErr) || authErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("Unauthorized accept error should have wrapped the AuthError, not: %s", err)
+	}
+
+	resp, err := http.Get("http" + strings.TrimPrefix(wsURL, "ws"))
+	if err != nil {
+		t.Fatalf("Could not make plain HTTP request to test listener; Details: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		t.Fatalf("Plain HTTP request should not have been upgraded")
+	}
+	expectErr(FailureUpgrade)
+
+	//The request ends once the upgrade fails, no websocket is used
+	rec := httptest.NewRecorder()
+	wsl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code < http.StatusBadRequest {
+		t.Fatalf("Request that could not be upgraded should have failed, not returned status %d", rec.Code)
+	}
+	expectErr(FailureUpgrade)
+	if active := wsl.Stats().Active; active != 0 {
+		t.Fatalf("Listener had %d active connections after failed upgrades", active)
+	}
+
+	wsl.Close()
+	if _, err = wsl.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept of a closed listener should have returned net.ErrClosed, not: %v", err)
+	}
+	if _, err = DialContext(testCtx, "websocket", wsURL); err == nil {
+		t.Fatalf("Dial of a closed listener should have failed")
+	}
+	if err := expectErr(FailureShutdown); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept error after close should have wrapped net.ErrClosed, not: %s", err)
+	}
+
+	expected := map[string]int64{FailureUnauthorized: 1, FailureUpgrade: 2, FailureShutdown: 1}
+	if failures := wsl.Failures(); len(failures) != len(expected) {
+		t.Fatalf("Listener failures were %v rather than %v", failures, expected)
+	} else {
+		for reason, count := range expected {
+			if failures[reason] != count {
+				t.Fatalf("Listener failures were %v rather than %v", failures, expected)
+			}
+		}
+	}
+}
+
+func TestListenerEcho(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsl, wsURL := newTestListener(t, ListenerOptions{})
+	go func() {
+		conn, err := wsl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := DialContext(testCtx, "websocket", wsURL)
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	defer conn.Close()
+
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	go conn.Write(msg)
+
+	readBuf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, readBuf); err != nil {
+		t.Fatalf("Read from echo listener failed; Details: %s", err)
+	}
+	if !bytes.Equal(msg, readBuf) {
+		t.Fatalf("Echo listener returned different bytes than were sent")
+	}
+}
+
+func TestListenerMessages(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsl, wsURL := newTestListener(t, ListenerOptions{})
+	go func() {
+		conn, err := wsl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		wsConn := conn.(*WebSockConn)
+
+		//Consume part of the first message as a stream, the rest as a message
+		prefix := make([]byte, 4)
+		if _, err := io.ReadFull(wsConn, prefix); err != nil {
+			return
+		}
+		typ, msg, err := wsConn.ReadMessage()
+		if err != nil {
+			return
+		}
+		wsConn.WriteMessage(typ, append(prefix, msg...))
+
+		for {
+			typ, msg, err := wsConn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = wsConn.WriteMessage(typ, msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn, err := DialContext(testCtx, "websocket", wsURL)
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	defer conn.Close()
+	msgConn := conn.(interface {
+		ReadMessage() (MessageType, []byte, error)
+		WriteMessage(MessageType, []byte) error
+	})
+
+	for _, expected := range []struct {
+		typ MessageType
+		msg string
+	}{{MessageBinary, "0123456789"}, {MessageText, `{"hello":"world"}`}, {MessageBinary, ""}, {MessageText, "done"}} {
+		if err := msgConn.WriteMessage(expected.typ, []byte(expected.msg)); err != nil {
+			t.Fatalf("Could not write %s message; Details: %s", expected.typ, err)
+		}
+		typ, msg, err := msgConn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Could not read %s message; Details: %s", expected.typ, err)
+		}
+		if typ != expected.typ || string(msg) != expected.msg {
+			t.Fatalf("Echoed %s message %q was not the %s message %q that was sent", typ, msg, expected.typ, expected.msg)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now())
+	if _, _, err = msgConn.ReadMessage(); err == nil {
+		t.Fatalf("ReadMessage should have failed after the read deadline")
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("ReadMessage after the read deadline failed with %q rather than a timeout", err)
+	}
+}
+
+func TestListenerTextMode(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsl, wsURL := newTestListener(t, ListenerOptions{MessageType: MessageText})
+	ws, _, err := websocket.Dial(testCtx, wsURL, nil)
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	defer ws.CloseNow()
+	conn, err := wsl.Accept()
+	if err != nil {
+		t.Fatalf("Could not accept test connection; Details: %s", err)
+	}
+	defer conn.Close()
+
+	const msg = `{"hello":"世界"}`
+	if err = ws.Write(testCtx, websocket.MessageText, []byte(msg)); err != nil {
+		t.Fatalf("Could not write text message; Details: %s", err)
+	}
+	readBuf := make([]byte, len(msg))
+	if _, err = io.ReadFull(conn, readBuf); err != nil || string(readBuf) != msg {
+		t.Fatalf("Text message was read as %q rather than %q; Details: %v", readBuf, msg, err)
+	}
+
+	if _, err = conn.Write(readBuf); err != nil {
+		t.Fatalf("Could not write text message; Details: %s", err)
+	}
+	if typ, echo, err := ws.Read(testCtx); err != nil || typ != websocket.MessageText || string(echo) != msg {
+		t.Fatalf("Received %s message %q rather than a text message %q; Details: %v", typ, echo, msg, err)
+	}
+
+	if _, err = conn.Write([]byte("bad \xff")); !errors.Is(err, ErrInvalidUTF8) {
+		t.Fatalf("Writing invalid UTF-8 should have failed with ErrInvalidUTF8, not: %v", err)
+	}
+	if err = ws.Write(testCtx, websocket.MessageText, []byte("bad \xff")); err != nil {
+		t.Fatalf("Could not write text message; Details: %s", err)
+	}
+	if _, err = conn.Read(readBuf); !errors.Is(err, ErrInvalidUTF8) {
+		t.Fatalf("Reading invalid UTF-8 should have failed with ErrInvalidUTF8, not: %v", err)
+	}
+	if _, _, err = ws.Read(testCtx); websocket.CloseStatus(err) != websocket.StatusInvalidFramePayloadData {
+		t.Fatalf("Websocket should have been closed with status %d after sending invalid UTF-8; Details: %v", websocket.StatusInvalidFramePayloadData, err)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	const (
+		testTO = time.Second * 10
+		limit  = 16
+	)
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsl, wsURL := newTestListener(t, ListenerOptions{ReadLimit: limit, Logger: nopLogger{}})
+	for _, size := range []int{limit + 1, limit * 100} {
+		client, _, err := websocket.Dial(testCtx, wsURL, nil)
+		if err != nil {
+			t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+		}
+		defer client.CloseNow()
+		server, err := wsl.Accept()
+		if err != nil {
+			t.Fatalf("Could not accept test connection; Details: %s", err)
+		}
+		defer server.Close()
+
+		msg := make([]byte, size)
+		if err = client.Write(testCtx, websocket.MessageBinary, msg[:limit]); err != nil {
+			t.Fatalf("Could not write to test connection; Details: %s", err)
+		}
+		if err = client.Write(testCtx, websocket.MessageBinary, msg); err != nil {
+			t.Fatalf("Could not write to test connection; Details: %s", err)
+		}
+		if _, err = io.ReadFull(server, msg[:limit]); err != nil {
+			t.Fatalf("Message of the read limit should have been received; Details: %s", err)
+		}
+		if _, err = io.ReadFull(server, msg); !errors.Is(err, ErrMessageTooBig) {
+			t.Fatalf("Read of a %d byte message should have failed with %v, not: %v", size, ErrMessageTooBig, err)
+		}
+		if _, _, err = client.Read(testCtx); websocket.CloseStatus(err) != websocket.StatusMessageTooBig {
+			t.Fatalf("Connection receiving a %d byte message should have been closed with %s; Details: %v", size, websocket.StatusMessageTooBig, err)
+		}
+	}
+
+	//Dialed connections and ReadMessage
+	dialer := Dialer{ReadLimit: limit}
+	client, err := dialer.DialContext(testCtx, "websocket", wsURL)
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	defer client.Close()
+	server, err := wsl.Accept()
+	if err != nil {
+		t.Fatalf("Could not accept test connection; Details: %s", err)
+	}
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server) //Respond to the closing handshake
+	if err = server.(*WebSockConn).WriteMessage(MessageBinary, make([]byte, limit+1)); err != nil {
+		t.Fatalf("Could not write to test connection; Details: %s", err)
+	}
+	if _, _, err = client.(interface {
+		ReadMessage() (MessageType, []byte, error)
+	}).ReadMessage(); !errors.Is(err, ErrMessageTooBig) {
+		t.Fatalf("ReadMessage of a message larger than the limit should have failed with %v, not: %v", ErrMessageTooBig, err)
+	}
+
+	//Listeners limit messages unless a negative limit is set
+	for readLimit, expected := range map[int64]int64{0: defaultReadLimit, -1: 0} {
+		wsl, wsURL := newTestListener(t, ListenerOptions{ReadLimit: readLimit})
+		client, err := DialContext(testCtx, "websocket", wsURL)
+		if err != nil {
+			t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+		}
+		defer client.Close()
+		server, err := wsl.Accept()
+		if err != nil {
+			t.Fatalf("Could not accept test connection; Details: %s", err)
+		}
+		defer server.Close()
+		go io.Copy(ioutil.Discard, client) //Respond to the closing handshake
+		if actual := server.(*WebSockConn).stream.readLimit; actual != expected {
+			t.Fatalf("ReadLimit %d resulted in a limit of %d rather than %d", readLimit, actual, expected)
+		}
+	}
+}
+
+func TestDialer(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsl, wsURL := newTestListener(t, ListenerOptions{Subprotocols: []string{"json.v2", "json.v1"}, MessageType: MessageText})
+	go func() {
+		conn, err := wsl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if protocol := conn.(*WebSockConn).Request().Header.Get("Sec-WebSocket-Protocol"); protocol == "json.v1" {
+			io.Copy(conn, conn)
+		}
+	}()
+
+	dialer := Dialer{Subprotocols: []string{"json.v1"}, MessageType: MessageText}
+	conn, err := dialer.DialContext(testCtx, "websocket", wsURL)
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	defer conn.Close()
+
+	const msg = `{"hello":"world"}`
+	if _, err = conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("Could not write text message; Details: %s", err)
+	}
+	readBuf := make([]byte, len(msg))
+	if _, err = io.ReadFull(conn, readBuf); err != nil || string(readBuf) != msg {
+		t.Fatalf("Echo listener returned %q rather than %q; Details: %v", readBuf, msg, err)
+	}
+}
+
+func TestListenerStats(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsl, wsURL := newTestListener(t, ListenerOptions{
+		Authenticate: func(req *http.Request) (interface{}, error) {
+			if req.URL.Query().Get("deny") != "" {
+				return nil, NewAuthError(http.StatusForbidden, "denied")
+			}
+			return nil, nil
+		},
+	})
+	if _, err := DialContext(testCtx, "websocket", wsURL+"?deny=1"); err == nil {
+		t.Fatalf("Dial should have been rejected")
+	}
+
+	clients := make([]net.Conn, 2)
+	servers := make([]net.Conn, len(clients))
+	for i := range clients {
+		var err error
+		if clients[i], err = DialContext(testCtx, "websocket", wsURL); err != nil {
+			t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+		}
+		if servers[i], err = wsl.Accept(); err != nil {
+			t.Fatalf("Could not accept test connection; Details: %s", err)
+		}
+	}
+	defer func() {
+		for i := range clients {
+			go io.Copy(ioutil.Discard, servers[i]) //Respond to the closing handshake
+			clients[i].Close()
+			servers[i].Close()
+		}
+	}()
+	if stats := wsl.Stats(); stats != (ListenerStats{Accepted: 2, Rejected: 1, Active: 2}) {
+		t.Fatalf("Listener stats after 2 accepted and 1 rejected connection were: %+v", stats)
+	}
+
+	for _, msg := range []string{"hello", "world!"} {
+		if _, err := clients[0].Write([]byte(msg)); err != nil {
+			t.Fatalf("Could not write to test connection; Details: %s", err)
+		}
+	}
+	readBuf := make([]byte, len("helloworld!"))
+	if _, err := io.ReadFull(servers[0], readBuf); err != nil {
+		t.Fatalf("Could not read from test connection; Details: %s", err)
+	}
+	stats := servers[0].(*WebSockConn).Stats()
+	if stats.BytesReceived != int64(len(readBuf)) || stats.MessagesReceived != 2 || stats.BytesSent != 0 || stats.MessagesSent != 0 {
+		t.Fatalf("Connection stats after receiving 2 messages of %d bytes were: %+v", len(readBuf), stats)
+	}
+	if stats.ConnectedAt.IsZero() || stats.LastActivity.Before(stats.ConnectedAt) || stats.Connected <= 0 {
+		t.Fatalf("Connection stats has invalid times: %+v", stats)
+	}
+
+	readErrCh := make(chan error, 1)
+	go func() { //Respond to the closing handshake
+		_, err := servers[1].Read(readBuf)
+		readErrCh <- err
+	}()
+	clients[1].Close()
+	if err := <-readErrCh; err != io.EOF {
+		t.Fatalf("Read of closed connection should have returned EOF, not: %v", err)
+	}
+	if active := wsl.Stats().Active; active != 1 {
+		t.Fatalf("Listener had %d rather than 1 active connections after a connection closed", active)
+	}
+}
+
+func TestListenerOverload(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	//Connections beyond MaxConnections are refused before upgrading
+	wsl, wsURL := newTestListener(t, ListenerOptions{MaxConnections: 1, Logger: nopLogger{}})
+	conn, err := DialContext(testCtx, "websocket", wsURL)
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	defer conn.Close()
+	serverConn, err := wsl.Accept()
+	if err != nil {
+		t.Fatalf("Could not accept test connection; Details: %s", err)
+	}
+	defer func() {
+		go io.Copy(ioutil.Discard, conn) //Respond to the closing handshake
+		serverConn.Close()
+	}()
+	if _, resp, err := websocket.Dial(testCtx, wsURL, nil); err == nil {
+		t.Fatalf("Dial beyond the connection limit should have been refused")
+	} else if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Dial beyond the connection limit should have been refused with 503; Details: %s", err)
+	}
+	if stats := wsl.Stats(); stats != (ListenerStats{Accepted: 1, Rejected: 1, Active: 1}) {
+		t.Fatalf("Listener stats after 1 accepted and 1 refused connection were: %+v", stats)
+	}
+
+	//Connections not accepted in time are closed with "try again later", both
+	// those in the accept queue and those waiting for room in it
+	wsl, wsURL = newTestListener(t, ListenerOptions{AcceptQueueSize: 1, AcceptTimeout: time.Millisecond * 100, Logger: nopLogger{}})
+	for _, state := range []string{"in", "waiting on"} {
+		client, _, err := websocket.Dial(testCtx, wsURL, nil)
+		if err != nil {
+			t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+		}
+		defer client.CloseNow()
+		if _, _, err = client.Read(testCtx); websocket.CloseStatus(err) != websocket.StatusTryAgainLater {
+			t.Fatalf("Connection %s a full accept queue should have been closed with %s; Details: %v", state, websocket.StatusTryAgainLater, err)
+		}
+	}
+	if stats := wsl.Stats(); stats.Accepted != 0 || stats.Rejected != 2 {
+		t.Fatalf("Listener stats after 2 timed out connections were: %+v", stats)
+	}
+
+	//Accept skips the abandoned connections
+	client, _, err := websocket.Dial(testCtx, wsURL, nil)
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	defer client.CloseNow()
+	if _, err = wsl.Accept(); err != nil {
+		t.Fatalf("Could not accept test connection; Details: %s", err)
+	}
+	if stats := wsl.Stats(); stats.Accepted != 1 || stats.Rejected != 2 {
+		t.Fatalf("Listener stats after 1 accepted and 2 timed out connections were: %+v", stats)
+	}
+}
+
+func TestListenerShutdown(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	const shutdownIdleTime = time.Millisecond * 200
+	wsl, wsURL := newTestListener(t, ListenerOptions{ShutdownIdleTime: shutdownIdleTime, Logger: nopLogger{}})
+	clients := make([]net.Conn, 2)
+	servers := make([]net.Conn, len(clients))
+	for i := range clients {
+		var err error
+		if clients[i], err = DialContext(testCtx, "websocket", wsURL); err != nil {
+			t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+		}
+		defer clients[i].Close()
+		if servers[i], err = wsl.Accept(); err != nil {
+			t.Fatalf("Could not accept test connection; Details: %s", err)
+		}
+		defer servers[i].Close()
+	}
+
+	//Keep the second connection busy until stopped
+	stopCh, writeErrCh, copyErrCh := make(chan struct{}), make(chan error, 1), make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stopCh:
+				writeErrCh <- nil
+				return
+			case <-time.After(shutdownIdleTime / 10):
+			}
+			if _, err := clients[1].Write([]byte("busy")); err != nil {
+				writeErrCh <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		_, err := io.Copy(ioutil.Discard, servers[1])
+		copyErrCh <- err
+	}()
+
+	shutdownErrCh := make(chan error, 1)
+	go func() { shutdownErrCh <- wsl.Shutdown(testCtx) }()
+
+	//The idle connection goes away, while the busy one continues
+	readBuf := make([]byte, 64)
+	if _, err := clients[0].Read(readBuf); err != io.EOF {
+		t.Fatalf("Read of an idle connection during shutdown should have returned EOF, not: %v", err)
+	}
+	if _, err := DialContext(testCtx, "websocket", wsURL); err == nil {
+		t.Fatalf("Dial during shutdown should have been refused")
+	}
+	select {
+	case err := <-shutdownErrCh:
+		t.Fatalf("Shutdown returned while a connection was busy; Details: %v", err)
+	case <-time.After(shutdownIdleTime * 2):
+	}
+
+	//Once idle the busy connection goes away too
+	close(stopCh)
+	if err := <-writeErrCh; err != nil {
+		t.Fatalf("Could not write to busy test connection during shutdown; Details: %s", err)
+	}
+	if _, err := clients[1].Read(readBuf); err != io.EOF {
+		t.Fatalf("Read of a connection that became idle during shutdown should have returned EOF, not: %v", err)
+	}
+	if err := <-copyErrCh; err != nil {
+		t.Fatalf("Server side of a connection that went away should have ended cleanly, not: %v", err)
+	}
+	if err := <-shutdownErrCh; err != nil {
+		t.Fatalf("Shutdown failed; Details: %s", err)
+	}
+	if active := wsl.Stats().Active; active != 0 {
+		t.Fatalf("Listener had %d active connections after shutdown", active)
+	}
+
+	//Connections still busy when the shutdown context expires are closed
+	wsl, wsURL = newTestListener(t, ListenerOptions{ShutdownIdleTime: shutdownIdleTime, Logger: nopLogger{}})
+	client, err := DialContext(testCtx, "websocket", wsURL)
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	defer client.Close()
+	server, err := wsl.Accept()
+	if err != nil {
+		t.Fatalf("Could not accept test connection; Details: %s", err)
+	}
+	if _, err = client.Write([]byte("busy")); err != nil {
+		t.Fatalf("Could not write to test connection; Details: %s", err)
+	}
+	if _, err = server.Read(readBuf); err != nil {
+		t.Fatalf("Could not read from test connection; Details: %s", err)
+	}
+	shutdownCtx, shutdownCancel := context.WithTimeout(testCtx, shutdownIdleTime/2)
+	defer shutdownCancel()
+	if err = wsl.Shutdown(shutdownCtx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown with a busy connection should have failed with %v, not: %v", context.DeadlineExceeded, err)
+	}
+	if _, err = server.Read(readBuf); err == nil {
+		t.Fatalf("Read of a connection closed by shutdown should have failed")
+	}
+}
+
+func TestListenerCompression(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsl, wsURL := newTestListener(t, ListenerOptions{
+		CompressionMode:      websocket.CompressionContextTakeover,
+		CompressionThreshold: 64,
+	})
+	for _, mode := range []websocket.CompressionMode{websocket.CompressionContextTakeover, websocket.CompressionDisabled} {
+		client, _, err := websocket.Dial(testCtx, wsURL, &websocket.DialOptions{CompressionMode: mode})
+		if err != nil {
+			t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+		}
+		defer client.CloseNow()
+		server, err := wsl.Accept()
+		if err != nil {
+			t.Fatalf("Could not accept test connection; Details: %s", err)
+		}
+		defer server.Close()
+
+		if compressed := server.(*WebSockConn).Stats().Compressed; compressed != (mode != websocket.CompressionDisabled) {
+			t.Fatalf("Connection stats reported compressed as %t when the client's compression mode was %v", compressed, mode)
+		}
+
+		msg := bytes.Repeat([]byte("compressible "), 100)
+		if err = client.Write(testCtx, websocket.MessageBinary, msg); err != nil {
+			t.Fatalf("Could not write to test connection; Details: %s", err)
+		}
+		readBuf := make([]byte, len(msg))
+		if _, err = io.ReadFull(server, readBuf); err != nil {
+			t.Fatalf("Could not read from test connection; Details: %s", err)
+		}
+		if _, err = server.Write(readBuf); err != nil {
+			t.Fatalf("Could not write to test connection; Details: %s", err)
+		}
+		if _, echo, err := client.Read(testCtx); err != nil || !bytes.Equal(echo, msg) {
+			t.Fatalf("Echoed message did not match (error: %v)", err)
+		}
+		client.CloseNow() //Don't wait for the closing handshake
+		server.Close()
+	}
+
+	for extensions, expected := range map[string]bool{
+		"":                   false,
+		"permessage-deflate": true,
+		"x-other, permessage-deflate; client_no_context_takeover": true,
+		"permessage-deflate-x": false,
+	} {
+		if deflateNegotiated(extensions) != expected {
+			t.Fatalf("Extensions %q should have reported compression as %t", extensions, expected)
+		}
+	}
+}
+
+func TestListenerKeepAlive(t *testing.T) {
+	const (
+		testTO   = time.Second * 10
+		interval = time.Millisecond * 50
+	)
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	//Clients that don't answer pings are closed
+	wsl, wsURL := newTestListener(t, ListenerOptions{PingInterval: interval, Logger: nopLogger{}})
+	clients := make([]net.Conn, 2)
+	readErrChs := make([]chan error, len(clients))
+	for i := range clients {
+		var err error
+		if clients[i], err = DialContext(testCtx, "websocket", wsURL); err != nil {
+			t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+		}
+		defer clients[i].Close()
+		server, err := wsl.Accept()
+		if err != nil {
+			t.Fatalf("Could not accept test connection; Details: %s", err)
+		}
+		defer server.Close()
+		readErrChs[i] = make(chan error, 1)
+		go func(errCh chan error) { //Reading receives pongs
+			_, err := io.Copy(ioutil.Discard, server)
+			errCh <- err
+		}(readErrChs[i])
+	}
+	go io.Copy(ioutil.Discard, clients[0]) //Reading answers pings
+	select {
+	case <-readErrChs[1]:
+		go io.Copy(ioutil.Discard, clients[1]) //Observe the close rather than waiting for the closing handshake
+	case <-testCtx.Done():
+		t.Fatalf("Connection that did not answer pings was not closed")
+	}
+	select {
+	case err := <-readErrChs[0]:
+		t.Fatalf("Connection that answered pings was closed; Details: %v", err)
+	case <-time.After(interval * 4):
+	}
+
+	//Connections without messages are closed after the idle timeout
+	wsl, wsURL = newTestListener(t, ListenerOptions{IdleTimeout: interval * 2, Logger: nopLogger{}})
+	client, err := DialContext(testCtx, "websocket", wsURL)
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	defer client.Close()
+	server, err := wsl.Accept()
+	if err != nil {
+		t.Fatalf("Could not accept test connection; Details: %s", err)
+	}
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+	var lastWrite time.Time
+	for start := time.Now(); time.Since(start) < interval*4; time.Sleep(interval / 2) { //Messages keep the connection open
+		if _, err = client.Write([]byte("active")); err != nil {
+			t.Fatalf("Connection with messages was closed; Details: %s", err)
+		}
+		lastWrite = time.Now()
+	}
+	if _, err = client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read of an idle connection should have returned EOF, not: %v", err)
+	}
+	if idle := time.Since(lastWrite); idle < interval*2 {
+		t.Fatalf("Connection was closed after being idle for %s, before the idle timeout", idle)
+	}
+
+	//A message being written counts as traffic
+	client, err = DialContext(testCtx, "websocket", wsURL)
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	defer client.Close()
+	server, err = wsl.Accept()
+	if err != nil {
+		t.Fatalf("Could not accept test connection; Details: %s", err)
+	}
+	defer server.Close()
+	stream := server.(*WebSockConn).stream
+	atomic.StoreInt32(&stream.writing, 1) //As if blocked writing to a slow client
+	select {
+	case <-stream.done:
+		t.Fatalf("Connection was closed as idle while writing")
+	case <-time.After(interval * 6):
+	}
+	atomic.StoreInt32(&stream.writing, 0)
+	if _, err = client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read of an idle connection should have returned EOF, not: %v", err)
+	}
+
+	//Connections waiting to be accepted are not pinged
+	wsl, wsURL = newTestListener(t, ListenerOptions{PingInterval: interval, Logger: nopLogger{}})
+	if client, err = DialContext(testCtx, "websocket", wsURL); err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	defer client.Close()
+	time.Sleep(interval * 4) //Long enough to miss pongs if pinged
+	if server, err = wsl.Accept(); err != nil {
+		t.Fatalf("Could not accept test connection; Details: %s", err)
+	}
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+	if _, err = server.Write([]byte("queued")); err != nil {
+		t.Fatalf("Connection that waited to be accepted was closed; Details: %s", err)
+	}
+	if _, err = io.ReadFull(client, make([]byte, len("queued"))); err != nil {
+		t.Fatalf("Could not read from connection that waited to be accepted; Details: %s", err)
+	}
+}
+
+type testGreeter struct{}
+
+func (testGreeter) SayHello(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
+	req, ok := GRPCUpgradeRequest(ctx)
+	if !ok {
+		return nil, errors.New("upgrade request was not available")
+	}
+	p, _ := peer.FromContext(ctx)
+	return &pb.HelloReply{Message: req.Header.Get("User-Agent") + " " + p.Addr.Network()}, nil
+}
+
+func TestListenerGRPC(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsl, wsURL := newTestListener(t, ListenerOptions{})
+	grpcServer := grpc.NewServer(grpc.Creds(GRPCServerCredentials(nil)))
+	pb.RegisterGreeterServer(grpcServer, testGreeter{})
+	go grpcServer.Serve(wsl)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.DialContext(testCtx, "passthrough:///"+wsURL, grpc.WithContextDialer(GRPCDialer), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatalf("Could not gRPC dial test listener at %q; Details: %s", wsURL, err)
+	}
+	defer conn.Close()
+
+	reply, err := pb.NewGreeterClient(conn).SayHello(testCtx, &pb.HelloRequest{Name: "test"})
+	if err != nil {
+		t.Fatalf("gRPC call failed; Details: %s", err)
+	}
+	if expected := "Go-http-client/1.1 " + (&net.TCPAddr{}).Network(); reply.GetMessage() != expected {
+		t.Fatalf("gRPC reply was %q rather than %q", reply.GetMessage(), expected)
+	}
+}
+
+func TestListenerResume(t *testing.T) {
+	const testTO = time.Second * 20
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsl, wsURL := newTestListener(t, ListenerOptions{Resume: &ResumeOptions{ReplayBufferSize: 64 * 1024}})
+	go func() {
+		conn, err := wsl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := DialResumable(testCtx, wsURL, nil)
+	if err != nil {
+		t.Fatalf("Could not dial resumable test listener at %q; Details: %s", wsURL, err)
+	}
+	defer conn.Close()
+
+	//Write a known sequence while repeatedly killing the underlying websocket
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	go func() {
+		for offset := 0; offset < len(msg); offset += 64 * 1024 {
+			conn.Write(msg[offset : offset+64*1024])
+		}
+	}()
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(time.Millisecond * 20)
+			if transport := conn.(*resumableConn).NetConn(); transport != nil {
+				transport.Close()
+			}
+		}
+	}()
+
+	readBuf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, readBuf); err != nil {
+		t.Fatalf("Read from resumable echo listener failed; Details: %s", err)
+	}
+	if !bytes.Equal(msg, readBuf) {
+		t.Fatalf("Resumable echo listener returned different bytes than were sent")
+	}
+}
+
+func TestListenerResumeDialer(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	//Every websocket of the session is dialed with the Dialer's options
+	protocolCh := make(chan string, 4)
+	wsl, wsURL := newTestListener(t, ListenerOptions{
+		Subprotocols: []string{"test"},
+		Resume:       &ResumeOptions{},
+		Authenticate: func(req *http.Request) (interface{}, error) {
+			protocolCh <- req.Header.Get("Sec-WebSocket-Protocol")
+			return nil, nil
+		},
+	})
+	go func() {
+		conn, err := wsl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	dialer := Dialer{Subprotocols: []string{"test"}}
+	conn, err := dialer.DialResumable(testCtx, wsURL, nil)
+	if err != nil {
+		t.Fatalf("Could not dial resumable test listener at %q; Details: %s", wsURL, err)
+	}
+	defer conn.Close()
+	conn.(*resumableConn).NetConn().Close()
+	if _, err = conn.Write([]byte("resumed")); err != nil {
+		t.Fatalf("Write to resumable connection failed; Details: %s", err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, len("resumed"))); err != nil {
+		t.Fatalf("Read from resumable echo listener failed; Details: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case protocol := <-protocolCh:
+			if protocol != "test" {
+				t.Fatalf("Websocket %d of the session offered subprotocols %q rather than the Dialer's", i, protocol)
+			}
+		case <-testCtx.Done():
+			t.Fatalf("Session was not redialed")
+		}
+	}
+}
+
+func TestListenerResumeClose(t *testing.T) {
+	const testTO = time.Second * 20
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsl, wsURL := newTestListener(t, ListenerOptions{
+		Resume: &ResumeOptions{},
+		Authenticate: func(req *http.Request) (interface{}, error) {
+			return req.URL.Query().Get("user"), nil
+		},
+		Logger: nopLogger{},
+	})
+
+	//Redials wait until released
+	releaseCh := make(chan struct{})
+	dialed := false
+	conn, err := dialResumable(testCtx, nil, func(ctx context.Context) (net.Conn, error) {
+		if dialed {
+			select {
+			case <-releaseCh:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		dialed = true
+		return DialContext(ctx, "websocket", wsURL+"?user=test")
+	})
+	if err != nil {
+		t.Fatalf("Could not dial resumable test listener at %q; Details: %s", wsURL, err)
+	}
+	defer conn.Close()
+	server, err := wsl.Accept()
+	if err != nil {
+		t.Fatalf("Could not accept test connection; Details: %s", err)
+	}
+	defer server.Close()
+	rc := conn.(*resumableConn)
+
+	//Sessions can only be resumed by the identity that started them
+	transport, err := DialContext(testCtx, "websocket", wsURL+"?user=other")
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	if _, _, err = clientHello(transport, rc.id, 0); err != ErrSessionExpired {
+		t.Fatalf("Resuming a session as a different identity should have failed with %v, not: %v", ErrSessionExpired, err)
+	}
+	transport.Close()
+
+	//Data written before closing during a reconnect is delivered, then EOF
+	if _, err = conn.Write([]byte("hello ")); err != nil {
+		t.Fatalf("Could not write to test connection; Details: %s", err)
+	}
+	readBuf := make([]byte, len("hello "))
+	if _, err = io.ReadFull(server, readBuf); err != nil {
+		t.Fatalf("Could not read from test connection; Details: %s", err)
+	}
+	if stats := server.(interface{ Stats() ConnStats }).Stats(); stats.BytesReceived != int64(len(readBuf)) || stats.MessagesReceived != 1 {
+		t.Fatalf("Session stats after receiving 1 message of %d bytes were: %+v", len(readBuf), stats)
+	}
+	rc.NetConn().Close()
+	for rc.NetConn() != nil {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if _, err = conn.Write([]byte("goodbye")); err != nil {
+		t.Fatalf("Could not write to disconnected test connection; Details: %s", err)
+	}
+	conn.Close()
+	close(releaseCh)
+	if rest, err := ioutil.ReadAll(server); err != nil || string(rest) != "goodbye" {
+		t.Fatalf("Session closed during a reconnect should have delivered %q then EOF, not: %q (error: %v)", "goodbye", rest, err)
+	}
+}
+
+func TestListenerCloseResumable(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsl, wsURL := newTestListener(t, ListenerOptions{Resume: &ResumeOptions{}, Logger: nopLogger{}})
+	conn, err := DialResumable(testCtx, wsURL, &ResumeOptions{Timeout: time.Millisecond * 100})
+	if err != nil {
+		t.Fatalf("Could not dial resumable test listener at %q; Details: %s", wsURL, err)
+	}
+	defer conn.Close()
+	server, err := wsl.Accept()
+	if err != nil {
+		t.Fatalf("Could not accept test connection; Details: %s", err)
+	}
+	defer server.Close()
+
+	//Sessions awaiting resumption end once the listener is closed, rather than
+	// when their timeout elapses
+	conn.(*resumableConn).NetConn().Close()
+	for server.(*resumableConn).NetConn() != nil {
+		time.Sleep(time.Millisecond * 10)
+	}
+	wsl.Close()
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = server.Read(make([]byte, 1)); err != ErrSessionExpired {
+		t.Fatalf("Read of a disconnected session of a closed listener should have failed with %v, not: %v", ErrSessionExpired, err)
+	}
+}
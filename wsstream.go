@@ -0,0 +1,455 @@
+// +build !js,!wasm
+
+package wasmws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"nhooyr.io/websocket"
+)
+
+//wsStream adapts a nhooyr.io/websocket connection to both a byte stream (Read
+// and Write) and a pipe of messages (ReadMessage and WriteMessage), which share
+// the same deadlines. Like websocket.NetConn, an operation that is in progress
+// when its deadline expires closes the websocket, while operations started after
+// a deadline has expired return a timeout error. Text messages are validated to
+// be UTF-8 in both directions.
+type wsStream struct {
+	ws         *websocket.Conn
+	streamType MessageType //The type of messages Read expects and Write sends
+	counters   *connCounters
+	metrics    MetricsCollector //Receives the bytes sent and received
+
+	closeOnce sync.Once
+	done      chan struct{} //Closed once the websocket is closed or fails
+	onClose   func()        //Called once the websocket is closed or fails, if set
+
+	writing int32 //Set (atomically) while a message is being written
+
+	readLock     sync.Mutex
+	readCtx      context.Context
+	readDeadline opDeadline
+	readEOF      bool
+	readLimit    int64     //The maximum size of received messages, if positive
+	reader       io.Reader //The remainder of a message partially consumed by Read
+	readerType   MessageType
+	readerUTF8   utf8Validator
+	readerSize   int64 //Bytes of the current message consumed so far
+
+	writeLock     sync.Mutex
+	writeCtx      context.Context
+	writeDeadline opDeadline
+}
+
+//newWSStream returns a stream for the provided websocket, the context bounds
+// the lifetime of the stream
+func newWSStream(ctx context.Context, ws *websocket.Conn, streamType MessageType) *wsStream {
+	st := &wsStream{
+		ws:         ws,
+		streamType: streamType,
+		counters:   newConnCounters(),
+		metrics:    nopMetrics{},
+		done:       make(chan struct{}),
+	}
+	st.readCtx, st.readDeadline.cancel = context.WithCancel(ctx)
+	st.writeCtx, st.writeDeadline.cancel = context.WithCancel(ctx)
+	return st
+}
+
+//setReadLimit limits the size of received messages to the provided number of
+// bytes, if not positive no limit is enforced; Call before the stream is used!
+func (st *wsStream) setReadLimit(limit int64) {
+	if limit > 0 {
+		st.readLimit = limit
+		st.ws.SetReadLimit(limit)
+	} else {
+		st.readLimit = 0
+		st.ws.SetReadLimit(-1)
+	}
+}
+
+//Read implements the standard io.Reader interface, message boundaries are not
+// preserved
+func (st *wsStream) Read(buf []byte) (n int, err error) {
+	st.readLock.Lock()
+	defer st.readLock.Unlock()
+
+	if err = st.readDeadline.begin(); err != nil {
+		return 0, err
+	}
+	defer func() { err = st.readDeadline.end(err) }()
+
+	for {
+		if st.reader == nil {
+			typ, rdr, err := st.nextReader()
+			if err != nil {
+				return 0, err
+			}
+			if typ != st.streamType {
+				err = fmt.Errorf("WebSocket: Received a %s message when %s messages were expected", typ, st.streamType)
+				go st.ws.Close(websocket.StatusUnsupportedData, err.Error()) //Don't wait for the closing handshake
+				return 0, err
+			}
+			st.reader, st.readerType = rdr, typ
+		}
+
+		n, err := st.reader.Read(buf)
+		st.counters.received(n, false)
+		st.metrics.BytesReceived(n)
+		st.readerSize += int64(n)
+		if st.tooBig(st.readerSize, err) {
+			return 0, st.messageTooBig()
+		}
+		if err != nil && err != io.EOF {
+			st.closed() //Read errors are fatal to nhooyr.io/websocket connections
+		}
+		if st.readerType == MessageText && !st.readerUTF8.valid(buf[:n], err == io.EOF) {
+			return 0, st.invalidUTF8()
+		}
+		if err == io.EOF {
+			st.reader, err = nil, nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+//ReadMessage returns the next message, or the remainder of the current message
+// if it was partially consumed by Read. The whole message is buffered in memory,
+// so only the read limit bounds its size.
+func (st *wsStream) ReadMessage() (typ MessageType, msg []byte, err error) {
+	st.readLock.Lock()
+	defer st.readLock.Unlock()
+
+	if err = st.readDeadline.begin(); err != nil {
+		return 0, nil, err
+	}
+	defer func() { err = st.readDeadline.end(err) }()
+
+	typ, rdr := st.readerType, st.reader
+	st.reader = nil
+	if rdr == nil {
+		if typ, rdr, err = st.nextReader(); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	msg, err = ioutil.ReadAll(rdr)
+	st.counters.received(len(msg), false)
+	st.metrics.BytesReceived(len(msg))
+	if st.tooBig(st.readerSize+int64(len(msg)), err) {
+		return 0, nil, st.messageTooBig()
+	}
+	if err != nil {
+		st.closed() //Read errors are fatal to nhooyr.io/websocket connections
+		return 0, nil, err
+	}
+	if typ == MessageText && !st.readerUTF8.valid(msg, true) {
+		return 0, nil, st.invalidUTF8()
+	}
+	return typ, msg, nil
+}
+
+//nextReader returns a reader for the next message, a normal closure by the
+// remote side is reported as io.EOF; Only call while holding readLock!
+func (st *wsStream) nextReader() (MessageType, io.Reader, error) {
+	if st.readEOF {
+		return 0, nil, io.EOF
+	}
+
+	typ, rdr, err := st.ws.Reader(st.readCtx)
+	if err != nil {
+		st.closed()
+		switch websocket.CloseStatus(err) {
+		case websocket.StatusNormalClosure, websocket.StatusGoingAway:
+			st.readEOF = true
+			return 0, nil, io.EOF
+		}
+		return 0, nil, err
+	}
+	st.counters.received(0, true)
+	st.readerUTF8.reset()
+	st.readerSize = 0
+	return MessageType(typ), rdr, nil
+}
+
+//invalidUTF8 fails the websocket after receiving a text message that is not
+// valid UTF-8 as RFC 6455 requires, and returns the error for the caller
+func (st *wsStream) invalidUTF8() error {
+	st.reader = nil
+	err := fmt.Errorf("WebSocket: Received an invalid text message; Details: %w", ErrInvalidUTF8)
+	go st.ws.Close(websocket.StatusInvalidFramePayloadData, ErrInvalidUTF8.Error()) //Don't wait for the closing handshake
+	return err
+}
+
+//tooBig returns true if the current message exceeds the read limit given the
+// bytes of it consumed and the error reading them. nhooyr.io/websocket fails the
+// read (and the websocket) after the limit but may allow a single extra byte.
+func (st *wsStream) tooBig(size int64, err error) bool {
+	if st.readLimit <= 0 {
+		return false
+	}
+	return size > st.readLimit || (err != nil && err != io.EOF && size >= st.readLimit)
+}
+
+//messageTooBig fails the websocket after receiving a message that exceeds the
+// read limit, and returns the error for the caller
+func (st *wsStream) messageTooBig() error {
+	st.reader = nil
+	st.closed()
+	go st.ws.Close(websocket.StatusMessageTooBig, ErrMessageTooBig.Error()) //Don't wait for the closing handshake
+	return fmt.Errorf("WebSocket: Received a message larger than the %d byte limit; Details: %w", st.readLimit, ErrMessageTooBig)
+}
+
+//Write implements the standard io.Writer interface, each write is sent as a
+// single websocket message
+func (st *wsStream) Write(buf []byte) (int, error) {
+	if err := st.WriteMessage(st.streamType, buf); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+//WriteMessage sends the provided data as a single websocket message of the
+// provided type, ErrInvalidUTF8 is returned for text that is not valid UTF-8
+func (st *wsStream) WriteMessage(typ MessageType, msg []byte) (err error) {
+	switch typ {
+	case MessageText:
+		if !utf8.Valid(msg) {
+			return ErrInvalidUTF8
+		}
+	case MessageBinary:
+	default:
+		return fmt.Errorf("WebSocket: Invalid message type: %s", typ)
+	}
+
+	st.writeLock.Lock()
+	defer st.writeLock.Unlock()
+
+	if err = st.writeDeadline.begin(); err != nil {
+		return err
+	}
+	defer func() { err = st.writeDeadline.end(err) }()
+
+	atomic.StoreInt32(&st.writing, 1)
+	defer atomic.StoreInt32(&st.writing, 0)
+	if err = st.ws.Write(st.writeCtx, websocket.MessageType(typ), msg); err != nil {
+		st.closed() //Write errors are fatal to nhooyr.io/websocket connections
+		return err
+	}
+	st.counters.sent(len(msg), true)
+	st.metrics.BytesSent(len(msg))
+	return nil
+}
+
+//Close closes the websocket with a normal closure status, it waits for the
+// closing handshake so the peer reads io.EOF and reads in progress return once
+// it completes. This may block for up to nhooyr.io/websocket's 5 second closing
+// handshake timeout if the peer is not reading.
+func (st *wsStream) Close() error {
+	defer st.closed()
+	//Reads in progress are completed by the closing handshake, canceling their
+	// context first would close the websocket without it
+	err := st.ws.Close(websocket.StatusNormalClosure, "")
+	st.readDeadline.close()
+	st.writeDeadline.close()
+	return err
+}
+
+//goAway closes the websocket with a going away status, as is done when a server
+// shuts down, without waiting for the closing handshake to complete
+func (st *wsStream) goAway(reason string) {
+	go func() {
+		defer st.closed()
+		st.ws.Close(websocket.StatusGoingAway, reason)
+	}()
+}
+
+//keepAlive pings the peer every pingInterval and fails the websocket if a pong
+// is not received within pongTimeout, it also closes the websocket once no
+// message has been sent or received for idleTimeout; Zero durations disable
+// either; A message being written counts as traffic. It returns once the
+// websocket is closed, with the reason if it was closed by keepAlive. Pongs are
+// only received while the websocket is being read.
+func (st *wsStream) keepAlive(pingInterval, pongTimeout, idleTimeout time.Duration) error {
+	var pingCh, idleCh <-chan time.Time
+	if pingInterval > 0 {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		pingCh = ticker.C
+	}
+	var idleTimer *time.Timer
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idleCh = idleTimer.C
+	}
+
+	for {
+		select {
+		case <-st.done:
+			return nil
+
+		case <-pingCh:
+			ctx, cancel := context.WithTimeout(context.Background(), pongTimeout)
+			err := st.ws.Ping(ctx)
+			cancel()
+			if err != nil {
+				st.closed()
+				if errors.Is(err, net.ErrClosed) {
+					return nil
+				}
+				return fmt.Errorf("WebSocket: Peer did not respond to ping within %s; Details: %w", pongTimeout, err)
+			}
+
+		case <-idleCh:
+			if !st.idle(idleTimeout) {
+				wait := idleTimeout - time.Since(st.counters.lastActive())
+				if wait <= 0 { //A message is being written
+					wait = idleTimeout
+				}
+				idleTimer.Reset(wait)
+				continue
+			}
+			st.goAway("Idle timeout")
+			return fmt.Errorf("WebSocket: No messages were sent or received for %s", idleTimeout)
+		}
+	}
+}
+
+//idle returns true if no message is being written and none has been sent or
+// received for at least the provided duration
+func (st *wsStream) idle(quiet time.Duration) bool {
+	return atomic.LoadInt32(&st.writing) == 0 && time.Since(st.counters.lastActive()) >= quiet
+}
+
+//Stats returns the statistics of the stream
+func (st *wsStream) Stats() ConnStats {
+	return st.counters.stats()
+}
+
+//closed calls onClose the first time the websocket is found to be closed
+func (st *wsStream) closed() {
+	st.closeOnce.Do(func() {
+		close(st.done)
+		if st.onClose != nil {
+			st.onClose()
+		}
+	})
+}
+
+//SetDeadline implements the Conn SetDeadline method
+func (st *wsStream) SetDeadline(future time.Time) error {
+	st.readDeadline.set(future)
+	st.writeDeadline.set(future)
+	return nil
+}
+
+//SetReadDeadline implements the Conn SetReadDeadline method
+func (st *wsStream) SetReadDeadline(future time.Time) error {
+	st.readDeadline.set(future)
+	return nil
+}
+
+//SetWriteDeadline implements the Conn SetWriteDeadline method
+func (st *wsStream) SetWriteDeadline(future time.Time) error {
+	st.writeDeadline.set(future)
+	return nil
+}
+
+//opDeadline is the deadline of one kind of operation (reads or writes). If it
+// expires while an operation is in progress, the context of the operations is
+// canceled which closes the websocket.
+type opDeadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired bool
+	active  bool               //An operation is in progress
+	cancel  context.CancelFunc //Cancels the context of the operations
+}
+
+//set replaces the deadline, the zero time clears it
+func (dl *opDeadline) set(future time.Time) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if dl.timer != nil {
+		dl.timer.Stop()
+		dl.timer = nil
+	}
+	dl.expired = false
+	if future.IsZero() {
+		return
+	}
+
+	wait := time.Until(future)
+	if wait <= 0 {
+		dl.expireLocked()
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(wait, func() {
+		dl.mu.Lock()
+		defer dl.mu.Unlock()
+		if dl.timer == timer { //Not replaced since
+			dl.expireLocked()
+		}
+	})
+	dl.timer = timer
+}
+
+//expireLocked marks the deadline expired; Only call while holding mu!
+func (dl *opDeadline) expireLocked() {
+	dl.expired = true
+	if dl.active {
+		dl.cancel()
+	}
+}
+
+//begin starts an operation, a timeout error is returned if the deadline has
+// already expired; end must be called once the operation completes
+func (dl *opDeadline) begin() error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if dl.expired {
+		return timeoutError{}
+	}
+	dl.active = true
+	return nil
+}
+
+//end completes the current operation, the operation's error is returned unless
+// the deadline expired during it, then a timeout error is returned instead
+func (dl *opDeadline) end(err error) error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	dl.active = false
+	if err != nil && dl.expired {
+		return timeoutError{}
+	}
+	return err
+}
+
+//close stops the deadline's timer and cancels the context of the operations
+func (dl *opDeadline) close() {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if dl.timer != nil {
+		dl.timer.Stop()
+		dl.timer = nil
+	}
+	dl.cancel()
+}
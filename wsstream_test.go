@@ -0,0 +1,57 @@
+// +build !js,!wasm
+
+package wasmws
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStreamCloseHandshake(t *testing.T) {
+	const testTO = time.Second * 10
+	testCtx, testCancel := context.WithTimeout(context.Background(), testTO)
+	defer testCancel()
+
+	wsl, wsURL := newTestListener(t, ListenerOptions{})
+	client, err := DialContext(testCtx, "websocket", wsURL)
+	if err != nil {
+		t.Fatalf("Could not dial test listener at %q; Details: %s", wsURL, err)
+	}
+	defer client.Close()
+	server, err := wsl.Accept()
+	if err != nil {
+		t.Fatalf("Could not accept test connection; Details: %s", err)
+	}
+
+	//Closing during a pending read completes the closing handshake
+	serverReadErrCh, clientReadErrCh := make(chan error, 1), make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		serverReadErrCh <- err
+	}()
+	go func() {
+		_, err := client.Read(make([]byte, 1))
+		clientReadErrCh <- err
+	}()
+	time.Sleep(time.Millisecond * 50) //Let the reads start
+	start := time.Now()
+	if err = server.Close(); err != nil {
+		t.Fatalf("Close of a connection with a pending read failed; Details: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Close took %s although the client was reading", elapsed)
+	}
+	if err = <-clientReadErrCh; err != io.EOF {
+		t.Fatalf("Client read should have returned EOF after a normal closure, not: %v", err)
+	}
+	select {
+	case err = <-serverReadErrCh:
+		if err == nil {
+			t.Fatalf("Pending read of a closed connection should have failed")
+		}
+	case <-testCtx.Done():
+		t.Fatalf("Pending read did not return after Close")
+	}
+}